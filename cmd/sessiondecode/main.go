@@ -0,0 +1,364 @@
+// Command sessiondecode decrypts captured streaming_transmit traffic given a key log written
+// by a Client or Server with KeyLog set.
+//
+// Traffic may either be provided as a pcap capture:
+//
+//	sessiondecode -keylog keys.log -pcap capture.pcap
+//
+// or as raw dumps of both directions of a single connection:
+//
+//	sessiondecode -keylog keys.log -client client.bin -server server.bin
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+
+	st "github.com/TheSmallBoat/carlo/streaming_transmit"
+)
+
+const publicKeySize = 32
+
+func main() {
+	var (
+		keyLogPath = flag.String("keylog", "", "path to the key log")
+		pcapPath   = flag.String("pcap", "", "path to a pcap capture")
+		clientPath = flag.String("client", "", "path to a raw dump of the client to server direction")
+		serverPath = flag.String("server", "", "path to a raw dump of the server to client direction")
+		padded     = flag.Bool("padded", false, "whether messages after the first were negotiated to be padded")
+	)
+	flag.Parse()
+
+	check := func(err error) {
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(*keyLogPath)
+	check(err)
+	keys, err := st.ParseKeyLog(f)
+	check(err)
+	check(f.Close())
+
+	switch {
+	case *pcapPath != "":
+		f, err := os.Open(*pcapPath)
+		check(err)
+		flows, err := readPcap(f)
+		check(err)
+		check(f.Close())
+
+		for _, conn := range pairFlows(flows) {
+			decodeConn(keys, conn.name, conn.client, conn.server, *padded)
+		}
+	case *clientPath != "" && *serverPath != "":
+		client, err := ioutil.ReadFile(*clientPath)
+		check(err)
+		server, err := ioutil.ReadFile(*serverPath)
+		check(err)
+
+		decodeConn(keys, "raw", client, server, *padded)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// decodeConn looks up the session key of a connection by the client public key sent at the
+// start of the client stream, and prints out all messages sent in both directions.
+func decodeConn(keys map[string][]byte, name string, client, server []byte, padded bool) {
+	var (
+		key    []byte
+		offset = -1
+	)
+
+	for i := 0; i+publicKeySize <= len(client) && i < 512; i++ {
+		if k, exists := keys[hex.EncodeToString(client[i:i+publicKeySize])]; exists {
+			key, offset = k, i+publicKeySize
+			break
+		}
+	}
+
+	if key == nil {
+		fmt.Printf("%s: no session key found in key log\n", name)
+		return
+	}
+
+	if len(server) < publicKeySize {
+		fmt.Printf("%s: server stream is too short to contain a handshake\n", name)
+		return
+	}
+
+	decodeStream(name+" client->server", key, client[offset:], padded)
+	decodeStream(name+" server->client", key, server[publicKeySize:], padded)
+}
+
+func decodeStream(name string, key []byte, stream []byte, padded bool) {
+	decoder, err := st.NewSessionDecoder(key)
+	if err != nil {
+		fmt.Printf("%s: %s\n", name, err)
+		return
+	}
+
+	messages, leftover := st.SplitMessages(stream)
+	for i, ciphertext := range messages {
+		plaintext, err := decoder.Decode(ciphertext)
+		if err != nil {
+			fmt.Printf("%s #%d: failed to decrypt: %s\n", name, i, err)
+			return
+		}
+		fmt.Printf("%s #%d (%d bytes): %q\n", name, i, len(plaintext), plaintext)
+
+		if i == 0 {
+			decoder.SetPadded(padded)
+		}
+	}
+
+	if len(leftover) > 0 {
+		fmt.Printf("%s: %d trailing byte(s) of an incomplete message\n", name, len(leftover))
+	}
+}
+
+type flowKey struct {
+	src, dst string
+}
+
+type segment struct {
+	seq  uint32
+	data []byte
+}
+
+type flow struct {
+	key      flowKey
+	syn      bool
+	isn      uint32
+	segments []segment
+}
+
+// assemble reassembles the payload of a flow from its segments, ignoring retransmissions.
+func (f *flow) assemble() []byte {
+	base := f.isn
+	if !f.syn && len(f.segments) > 0 {
+		base = f.segments[0].seq
+		for _, s := range f.segments {
+			if int32(s.seq-base) < 0 {
+				base = s.seq
+			}
+		}
+	}
+
+	sort.SliceStable(f.segments, func(i, j int) bool {
+		return int32(f.segments[i].seq-f.segments[j].seq) < 0
+	})
+
+	var buf []byte
+	for _, s := range f.segments {
+		offset := int(s.seq - base)
+		if offset < 0 || offset+len(s.data) <= len(buf) {
+			continue
+		}
+		if offset > len(buf) {
+			break // missing segment; nothing after it can be decoded
+		}
+		buf = append(buf, s.data[len(buf)-offset:]...)
+	}
+	return buf
+}
+
+type conn struct {
+	name           string
+	client, server []byte
+}
+
+// pairFlows pairs up both directions of every captured connection. The client is the side
+// that sent a SYN, or otherwise the side whose stream is tried first.
+func pairFlows(flows map[flowKey]*flow) []conn {
+	var conns []conn
+
+	seen := make(map[flowKey]bool)
+	for key, f := range flows {
+		if seen[key] {
+			continue
+		}
+		reverse := flowKey{src: key.dst, dst: key.src}
+		seen[key], seen[reverse] = true, true
+
+		r, exists := flows[reverse]
+		if !exists {
+			continue
+		}
+
+		client, server := f, r
+		if r.syn && !f.syn {
+			client, server = r, f
+		}
+
+		conns = append(conns, conn{
+			name:   client.key.src + "->" + client.key.dst,
+			client: client.assemble(),
+			server: server.assemble(),
+		})
+	}
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].name < conns[j].name })
+
+	return conns
+}
+
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// readPcap reads all TCP segments out of a classic pcap capture.
+func readPcap(r io.Reader) (map[flowKey]*flow, error) {
+	var header [24]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	switch magic := binary.LittleEndian.Uint32(header[:4]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a pcap capture: magic is %#x", magic)
+	}
+
+	linkType := order.Uint32(header[20:24])
+
+	flows := make(map[flowKey]*flow)
+
+	var record [16]byte
+	for {
+		_, err := io.ReadFull(r, record[:])
+		if errors.Is(err, io.EOF) {
+			return flows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pcap record header: %w", err)
+		}
+
+		packet := make([]byte, order.Uint32(record[8:12]))
+		_, err = io.ReadFull(r, packet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pcap record: %w", err)
+		}
+
+		packet, ok := stripLinkLayer(linkType, packet)
+		if !ok {
+			continue
+		}
+		parseIP(flows, packet)
+	}
+}
+
+func stripLinkLayer(linkType uint32, packet []byte) ([]byte, bool) {
+	switch linkType {
+	case linkTypeNull:
+		if len(packet) < 4 {
+			return nil, false
+		}
+		return packet[4:], true
+	case linkTypeEthernet:
+		if len(packet) < 14 {
+			return nil, false
+		}
+		etherType, packet := binary.BigEndian.Uint16(packet[12:14]), packet[14:]
+		for etherType == 0x8100 && len(packet) >= 4 { // vlan tags
+			etherType, packet = binary.BigEndian.Uint16(packet[2:4]), packet[4:]
+		}
+		return packet, etherType == 0x0800 || etherType == 0x86dd
+	case linkTypeRaw:
+		return packet, true
+	case linkTypeLinuxSLL:
+		if len(packet) < 16 {
+			return nil, false
+		}
+		return packet[16:], true
+	}
+	return nil, false
+}
+
+func parseIP(flows map[flowKey]*flow, packet []byte) {
+	if len(packet) < 1 {
+		return
+	}
+
+	var (
+		src, dst net.IP
+		payload  []byte
+	)
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if packet[9] != 6 || ihl < 20 || total < ihl || len(packet) < total {
+			return
+		}
+		src, dst, payload = net.IP(packet[12:16]), net.IP(packet[16:20]), packet[ihl:total]
+	case 6:
+		if len(packet) < 40 {
+			return
+		}
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if packet[6] != 6 || len(packet) < total {
+			return
+		}
+		src, dst, payload = net.IP(packet[8:24]), net.IP(packet[24:40]), packet[40:total]
+	default:
+		return
+	}
+
+	if len(payload) < 20 {
+		return
+	}
+
+	offset := int(payload[12]>>4) * 4
+	if offset < 20 || len(payload) < offset {
+		return
+	}
+
+	srcPort, dstPort := binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])
+	seq := binary.BigEndian.Uint32(payload[4:8])
+	syn := payload[13]&0x02 != 0
+
+	key := flowKey{
+		src: net.JoinHostPort(src.String(), fmt.Sprint(srcPort)),
+		dst: net.JoinHostPort(dst.String(), fmt.Sprint(dstPort)),
+	}
+
+	f, exists := flows[key]
+	if !exists {
+		f = &flow{key: key}
+		flows[key] = f
+	}
+
+	if syn {
+		f.syn, f.isn = true, seq+1
+		return
+	}
+
+	if data := payload[offset:]; len(data) > 0 {
+		f.segments = append(f.segments, segment{seq: seq, data: data})
+	}
+}
@@ -0,0 +1,110 @@
+package streaming_rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// MaxCallPacketSize is the largest size a CallRequestPacket or CallResponsePacket may be
+// encoded to. Calls whose request or response do not fit are streamed like with Push instead.
+// It leaves room for framing within the default read buffer size of a connection.
+const MaxCallPacketSize = 3072
+
+// Call sends req to the provider to be handled by the given service, and returns the response
+// along with its headers and trailers. Requests and responses are sent in a single packet if
+// they fit, which saves on allocations and round trips, and are streamed otherwise. The call
+// is canceled once ctx is done, and the deadline of ctx is propagated to the handler.
+func (p *Provider) Call(ctx context.Context, service string, headers map[string]string, req []byte) ([]byte, map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	headers = withTimeout(ctx, headers)
+
+	packet := CallRequestPacket{
+		Service: service,
+		Headers: headers,
+		Body:    req,
+	}
+
+	buf := packet.AppendTo([]byte{OpCodeCallRequest})
+	if len(buf) > MaxCallPacketSize {
+		stream, err := p.PushContext(ctx, []string{service}, headers, ioutil.NopCloser(bytes.NewReader(req)))
+		if err != nil {
+			return nil, nil, err
+		}
+		return readCall(stream)
+	}
+
+	// the stream id is only filled in once the request is known to fit in a single packet, as
+	// the stream is not needed otherwise
+
+	stream := p.NextStream()
+	binary.BigEndian.PutUint32(buf[1:], stream.ID)
+
+	if err := p.conn.Send(buf); err != nil {
+		err = fmt.Errorf("failed to send call: %s: %w", err, ErrProviderNotAvailable)
+		p.CloseStreamWithError(stream, err)
+		return nil, nil, err
+	}
+
+	p.finishSend(stream)
+
+	if ctx.Done() != nil {
+		go stream.cancelWhenDone(ctx)
+	}
+
+	return readCall(stream)
+}
+
+// readCall reads the response of a call in full.
+func readCall(stream *Stream) ([]byte, map[string]string, error) {
+	header, err := stream.ReadHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if stream.callBody != nil {
+		return stream.callBody, header.Headers, nil
+	}
+
+	res, err := ioutil.ReadAll(stream.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for key, val := range stream.Trailer {
+		header.Headers[key] = val
+	}
+
+	return res, header.Headers, nil
+}
+
+// Call sends req to a random provider of the given service through the middleware of the node.
+// See Provider.Call.
+func (n *StreamNode) Call(ctx context.Context, service string, headers map[string]string, req []byte) ([]byte, map[string]string, error) {
+	inv := &Invocation{Services: []string{service}, Headers: headers, Unary: true, Request: req}
+	if err := n.getInvoker()(ctx, inv); err != nil {
+		return nil, nil, err
+	}
+	return inv.Response, inv.ResponseHeaders, nil
+}
+
+func (n *StreamNode) call(ctx context.Context, service string, headers map[string]string, req []byte) ([]byte, map[string]string, error) {
+	for _, provider := range n.shuffledProviders(service) {
+		res, resHeaders, err := provider.Call(ctx, service, headers, req)
+		if err != nil {
+			if errors.Is(err, ErrProviderNotAvailable) {
+				continue
+			}
+			return nil, nil, err
+		}
+		return res, resHeaders, nil
+	}
+
+	return nil, nil, fmt.Errorf("no nodes were able to process your request for service: %s", service)
+}
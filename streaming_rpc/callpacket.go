@@ -0,0 +1,139 @@
+package streaming_rpc
+
+import (
+	"io"
+
+	"github.com/lithdew/bytesutil"
+)
+
+type CallRequestPacket struct {
+	StreamID uint32            // stream id
+	Service  string            // service this packet is to be processed through
+	Headers  map[string]string // headers for this packet
+	Body     []byte            // request body in full
+}
+
+func (p CallRequestPacket) AppendTo(dst []byte) []byte {
+	dst = bytesutil.AppendUint32BE(dst, p.StreamID)
+	dst = append(dst, uint8(len(p.Service)))
+	dst = append(dst, p.Service...)
+	dst = appendHeaders(dst, p.Headers)
+	dst = bytesutil.AppendUint32BE(dst, uint32(len(p.Body)))
+	dst = append(dst, p.Body...)
+	return dst
+}
+
+// UnmarshalCallRequestPacket decodes a CallRequestPacket. The body of the packet is copied
+// out of buf.
+func UnmarshalCallRequestPacket(buf []byte) (CallRequestPacket, error) {
+	var packet CallRequestPacket
+
+	if len(buf) < 4+1 {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.StreamID, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+
+	var serviceSize uint8
+	serviceSize, buf = buf[0], buf[1:]
+	if len(buf) < int(serviceSize) {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.Service, buf = string(buf[:serviceSize]), buf[serviceSize:]
+
+	headers, buf, err := unmarshalHeaders(buf)
+	if err != nil {
+		return packet, err
+	}
+	packet.Headers = headers
+
+	packet.Body, _, err = unmarshalBody(buf)
+	if err != nil {
+		return packet, err
+	}
+
+	return packet, nil
+}
+
+type CallResponsePacket struct {
+	StreamID uint32            // stream id
+	Status   StatusCode        // whether or not the service was handled successfully
+	Message  string            // describes why the service was not handled successfully
+	Details  []byte            // optional details on why the service was not handled successfully
+	Headers  map[string]string // response headers and trailers
+	Body     []byte            // response body in full
+}
+
+func (p CallResponsePacket) AppendTo(dst []byte) []byte {
+	dst = bytesutil.AppendUint32BE(dst, p.StreamID)
+	dst = appendStatus(dst, p.Status, p.Message, p.Details)
+	dst = appendHeaders(dst, p.Headers)
+	dst = bytesutil.AppendUint32BE(dst, uint32(len(p.Body)))
+	dst = append(dst, p.Body...)
+	return dst
+}
+
+// UnmarshalCallResponsePacket decodes a CallResponsePacket. The details and body of the packet
+// are copied out of buf.
+func UnmarshalCallResponsePacket(buf []byte) (CallResponsePacket, error) {
+	var packet CallResponsePacket
+
+	if len(buf) < 4+1+2 {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.StreamID, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+	packet.Status, buf = StatusCode(buf[0]), buf[1:]
+
+	var size uint16
+	size, buf = bytesutil.Uint16BE(buf[:2]), buf[2:]
+	if len(buf) < int(size) {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.Message, buf = string(buf[:size]), buf[size:]
+
+	if len(buf) < 2 {
+		return packet, io.ErrUnexpectedEOF
+	}
+	size, buf = bytesutil.Uint16BE(buf[:2]), buf[2:]
+	if len(buf) < int(size) {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.Details = make([]byte, size)
+	copy(packet.Details, buf[:size])
+	buf = buf[size:]
+
+	headers, buf, err := unmarshalHeaders(buf)
+	if err != nil {
+		return packet, err
+	}
+	packet.Headers = headers
+
+	packet.Body, _, err = unmarshalBody(buf)
+	if err != nil {
+		return packet, err
+	}
+
+	return packet, nil
+}
+
+// statusError returns the *StatusError the response carries, or nil if its status is StatusOK.
+func (p CallResponsePacket) statusError() *StatusError {
+	if p.Status == StatusOK {
+		return nil
+	}
+	return &StatusError{Code: p.Status, Message: p.Message, Details: p.Details}
+}
+
+// unmarshalBody copies out a body prefixed with its size, and returns the rest of buf.
+func unmarshalBody(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+	var size uint32
+	size, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+	if uint32(len(buf)) < size {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, size)
+	copy(body, buf[:size])
+	return body, buf[size:], nil
+}
@@ -0,0 +1,82 @@
+package streaming_rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+)
+
+// ContentTypeHeader is the header holding the name of the Codec the body of a request or
+// response registered with Register is encoded with.
+const ContentTypeHeader = "content-type"
+
+// Codec encodes and decodes the requests and responses of methods registered with Register.
+type Codec interface {
+	// Name is sent as the ContentTypeHeader of requests and responses encoded with the codec.
+	Name() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec Codec = jsonCodec{}
+	GobCodec  Codec = gobCodec{}
+)
+
+// DefaultCodec is used to encode requests made with Invoke if StreamNode.Codec is nil, and to
+// decode requests that do not specify a ContentTypeHeader.
+var DefaultCodec = JSONCodec
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		JSONCodec.Name(): JSONCodec,
+		GobCodec.Name():  GobCodec,
+	}
+)
+
+// RegisterCodec makes codec available for decoding requests and responses whose
+// ContentTypeHeader is its name. JSONCodec and GobCodec are registered by default.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+// codecFor returns the codec registered under name, or DefaultCodec if name is empty.
+func codecFor(name string) (Codec, bool) {
+	if name == "" {
+		return DefaultCodec, true
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, exists := codecs[name]
+	return codec, exists
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "application/json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "application/x-gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
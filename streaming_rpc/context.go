@@ -1,7 +1,11 @@
 package streaming_rpc
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
+	"time"
 
 	st "github.com/TheSmallBoat/carlo/streaming_transmit"
 	"github.com/lithdew/kademlia"
@@ -9,7 +13,14 @@ import (
 
 const ChunkSize = 2048
 
-type Handler func(ctx *Context)
+// TimeoutHeader is the header holding how much time is left until the deadline of a stream
+// passes, formatted as a time.Duration. The time left rather than the deadline itself is sent
+// such that the clocks of nodes do not need to be in sync.
+const TimeoutHeader = "timeout"
+
+// Handler handles a stream. The error it returns, if any, is mapped to a *StatusError with
+// ErrorStatus and sent back to the caller.
+type Handler func(ctx *Context) error
 
 type OpCode = uint8
 
@@ -20,20 +31,42 @@ const (
 	OpCodeData
 	OpCodeFindNodeRequest
 	OpCodeFindNodeResponse
+	OpCodeWindowUpdate
+	OpCodeReset
+	OpCodeCallRequest
+	OpCodeCallResponse
 )
 
 var _ io.Writer = (*Context)(nil)
 
 type Context struct {
 	KadId   kademlia.ID
+	Service string // name of the service being handled
 	Headers map[string]string
 	Body    io.ReadCloser
 
+	ctx      context.Context
 	streamId uint32 // stream id
 	conn     *st.Conn
+	provider *Provider
+	stream   *Stream
 
 	responseHeaders map[string]string // response headers
+	trailers        map[string]string // response trailers
 	written         bool              // written before?
+
+	unary      bool       // handling a call whose response is buffered to fit in a single packet
+	callBody   []byte     // buffered response of a call
+	callReader callReader // request of a call
+}
+
+// callReader is the body of the request of a call.
+type callReader struct {
+	bytes.Reader
+}
+
+func (r *callReader) Close() error {
+	return nil
 }
 
 func (c *Context) Conn() *st.Conn {
@@ -44,44 +77,167 @@ func (c *Context) WriteHeader(key, val string) {
 	c.responseHeaders[key] = val
 }
 
+// Done returns a channel that is closed once the stream being handled failed, either because
+// it was canceled or reset, or because its connection was closed.
+func (c *Context) Done() <-chan struct{} {
+	return c.stream.Done()
+}
+
+// Err returns why the stream being handled failed, or nil if it has not.
+func (c *Context) Err() error {
+	return c.stream.Err()
+}
+
+// Context returns a context.Context that is canceled once the stream being handled failed,
+// or once the deadline the caller set with TimeoutHeader passed, or once the handler returned.
+func (c *Context) Context() context.Context {
+	return c.ctx
+}
+
+// Reset aborts the stream being handled, such that reading its response fails with a
+// *ResetError of the given code and message on the side of the peer.
+func (c *Context) Reset(code ResetCode, message string) {
+	c.provider.resetStream(c.stream, code, message, &ResetError{Code: code, Message: message})
+}
+
+// SetTrailer sets a trailer to be sent once the handler returned, along with the end of the
+// response. Unlike headers, trailers may be set after the response was written to.
+func (c *Context) SetTrailer(key, val string) {
+	c.trailers[key] = val
+}
+
 // Implement Write function for io.Writer interface
 func (c *Context) Write(data []byte) (int, error) {
 	if len(data) == 0 { // disallow writing zero bytes
 		return 0, nil
 	}
 
-	if !c.written {
-		packet := ServiceResponsePacket{
-			StreamId: c.streamId,
-			Handled:  true,
-			Headers:  c.responseHeaders,
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	if c.unary {
+		c.callBody = append(c.callBody, data...)
+		if len(c.callBody) <= MaxCallPacketSize {
+			return len(data), nil
 		}
 
-		c.written = true
+		// the response outgrew a single packet, and is streamed instead
 
-		err := c.conn.Send(packet.AppendTo([]byte{OpCodeServiceResponse}))
-		if err != nil {
+		if err := c.streamCall(); err != nil {
 			return 0, err
 		}
+
+		return len(data), nil
 	}
 
-	for i := 0; i < len(data); i += ChunkSize {
-		start := i
-		end := i + ChunkSize
-		if end > len(data) {
-			end = len(data)
+	if !c.written {
+		err := c.writeResponse(nil)
+		if err != nil {
+			return 0, err
 		}
+	}
 
-		packet := DataPacket{
-			StreamID: c.streamId,
-			Data:     data[start:end],
-		}
+	return c.stream.Writer.Write(data)
+}
 
-		err := c.conn.Send(packet.AppendTo([]byte{OpCodeData}))
-		if err != nil {
-			return 0, err
+// streamCall sends the response buffered so far for a call over its stream, along with the
+// response header, and stops buffering the response of the call.
+func (c *Context) streamCall() error {
+	c.unary = false
+
+	if err := c.writeResponse(nil); err != nil {
+		return err
+	}
+
+	_, err := c.stream.Writer.Write(c.callBody)
+	c.callBody = c.callBody[:0]
+
+	return err
+}
+
+// writeCallResponse sends the response of a call in a single packet, with the given status or
+// with StatusOK if it is nil. It reports false if the response does not fit in a packet.
+func (c *Context) writeCallResponse(status *StatusError) (bool, error) {
+	headers := c.responseHeaders
+	if len(c.trailers) > 0 {
+		headers = make(map[string]string, len(c.responseHeaders)+len(c.trailers))
+		for key, val := range c.responseHeaders {
+			headers[key] = val
 		}
+		for key, val := range c.trailers {
+			headers[key] = val
+		}
+	}
+
+	packet := CallResponsePacket{
+		StreamID: c.streamId,
+		Status:   StatusOK,
+		Headers:  headers,
+		Body:     c.callBody,
+	}
+
+	if status != nil {
+		packet.Status = status.Code
+		packet.Message = status.Message
+		packet.Details = status.Details
+		packet.Body = nil
+	}
+
+	buf := packet.AppendTo([]byte{OpCodeCallResponse})
+	if len(buf) > MaxCallPacketSize {
+		return false, nil
 	}
 
-	return len(data), nil
+	c.written = true
+
+	return true, c.conn.Send(buf)
+}
+
+// writeResponse sends the response header of the stream, with the given status or with
+// StatusOK if it is nil.
+func (c *Context) writeResponse(status *StatusError) error {
+	packet := ServiceResponsePacket{
+		StreamId: c.streamId,
+		Status:   StatusOK,
+		Headers:  c.responseHeaders,
+	}
+
+	if status != nil {
+		packet.Status = status.Code
+		packet.Message = status.Message
+		packet.Details = status.Details
+	}
+
+	c.written = true
+
+	return c.conn.Send(packet.AppendTo([]byte{OpCodeServiceResponse}))
+}
+
+// streamContext returns a context.Context for handling the stream, which is canceled once the
+// stream failed, or once the timeout in headers passed, in which case the stream is reset.
+func (p *Provider) streamContext(stream *Stream, headers map[string]string) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if timeout, err := time.ParseDuration(headers[TimeoutHeader]); err == nil {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	go func() {
+		select {
+		case <-stream.Done():
+			cancel()
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				p.resetStream(stream, ResetDeadlineExceeded, ctx.Err().Error(), ctx.Err())
+			}
+		}
+	}()
+
+	return ctx, cancel
 }
@@ -1,10 +1,8 @@
 package streaming_rpc
 
 import (
-	"io"
 	"sync"
 
-	st "github.com/TheSmallBoat/carlo/streaming_transmit"
 	"github.com/lithdew/kademlia"
 )
 
@@ -14,26 +12,38 @@ type ContextPool struct {
 	sp sync.Pool
 }
 
-func (p *ContextPool) acquire(kadId kademlia.ID, headers map[string]string, body io.ReadCloser, streamId uint32, conn *st.Conn) *Context {
+func (p *ContextPool) acquire(kadId kademlia.ID, service string, headers map[string]string, provider *Provider, stream *Stream) *Context {
 	v := p.sp.Get()
 	if v == nil {
-		v = &Context{responseHeaders: make(map[string]string)}
+		v = &Context{responseHeaders: make(map[string]string), trailers: make(map[string]string)}
 	}
 	ctx := v.(*Context)
 	ctx.KadId = kadId
+	ctx.Service = service
 	ctx.Headers = headers
-	ctx.Body = body
+	ctx.Body = stream.Reader
 
-	ctx.streamId = streamId
-	ctx.conn = conn
+	ctx.streamId = stream.ID
+	ctx.conn = provider.conn
+	ctx.provider = provider
+	ctx.stream = stream
 
 	return ctx
 }
 
 func (p *ContextPool) release(ctx *Context) {
 	ctx.written = false
+	ctx.unary = false
+	ctx.callBody = ctx.callBody[:0]
+	ctx.callReader.Reset(nil)
+	ctx.ctx = nil
+	ctx.provider = nil
+	ctx.stream = nil
 	for key := range ctx.responseHeaders {
 		delete(ctx.responseHeaders, key)
 	}
+	for key := range ctx.trailers {
+		delete(ctx.trailers, key)
+	}
 	p.sp.Put(ctx)
 }
@@ -7,14 +7,18 @@ import (
 )
 
 type DataPacket struct {
-	StreamID uint32 // stream id
-	Data     []byte // payload
+	StreamID uint32            // stream id
+	Data     []byte            // payload
+	Trailers map[string]string // trailers sent along with the end of the stream, if any
 }
 
 func (p DataPacket) AppendTo(dst []byte) []byte {
 	dst = bytesutil.AppendUint32BE(dst, p.StreamID)
 	dst = bytesutil.AppendUint16BE(dst, uint16(len(p.Data)))
 	dst = append(dst, p.Data...)
+	if len(p.Trailers) > 0 {
+		dst = appendHeaders(dst, p.Trailers)
+	}
 	return dst
 }
 
@@ -30,5 +34,17 @@ func UnmarshalDataPacket(buf []byte) (DataPacket, error) {
 		return packet, io.ErrUnexpectedEOF
 	}
 	packet.Data, buf = buf[:size], buf[size:]
+
+	// trailers are optional, and follow the payload
+
+	if len(buf) == 0 {
+		return packet, nil
+	}
+	trailers, _, err := unmarshalHeaders(buf)
+	if err != nil {
+		return packet, err
+	}
+	packet.Trailers = trailers
+
 	return packet, nil
 }
@@ -0,0 +1,82 @@
+package streaming_rpc
+
+import (
+	"io"
+	"math"
+
+	"github.com/lithdew/bytesutil"
+)
+
+// appendString16 appends s to dst, prefixed with its length as a uint16. s is truncated to
+// math.MaxUint16 bytes, such that the length prefix always matches what follows it.
+func appendString16(dst []byte, s string) []byte {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+	dst = bytesutil.AppendUint16BE(dst, uint16(len(s)))
+	dst = append(dst, s...)
+	return dst
+}
+
+// appendStatus appends the status of a response along with the message and details describing
+// it, each of which is truncated to math.MaxUint16 bytes.
+func appendStatus(dst []byte, status StatusCode, message string, details []byte) []byte {
+	if len(details) > math.MaxUint16 {
+		details = details[:math.MaxUint16]
+	}
+	dst = append(dst, byte(status))
+	dst = appendString16(dst, message)
+	dst = bytesutil.AppendUint16BE(dst, uint16(len(details)))
+	dst = append(dst, details...)
+	return dst
+}
+
+// appendHeaders appends headers to dst, prefixed with how many there are.
+func appendHeaders(dst []byte, headers map[string]string) []byte {
+	dst = bytesutil.AppendUint16BE(dst, uint16(len(headers)))
+	for name, value := range headers {
+		dst = append(dst, byte(len(name)))
+		dst = append(dst, name...)
+		dst = bytesutil.AppendUint16BE(dst, uint16(len(value)))
+		dst = append(dst, value...)
+	}
+	return dst
+}
+
+// unmarshalHeaders decodes headers appended by appendHeaders, and returns the rest of buf.
+func unmarshalHeaders(buf []byte) (map[string]string, []byte, error) {
+	if len(buf) < 2 {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+
+	var size uint16
+	size, buf = bytesutil.Uint16BE(buf[:2]), buf[2:]
+
+	headers := make(map[string]string, size)
+	for i := uint16(0); i < size; i++ {
+		if len(buf) < 1 {
+			return nil, buf, io.ErrUnexpectedEOF
+		}
+		var nameSize uint8
+		nameSize, buf = buf[0], buf[1:]
+		if len(buf) < int(nameSize) {
+			return nil, buf, io.ErrUnexpectedEOF
+		}
+		var name string
+		name, buf = string(buf[:nameSize]), buf[nameSize:]
+
+		if len(buf) < 2 {
+			return nil, buf, io.ErrUnexpectedEOF
+		}
+		var valueSize uint16
+		valueSize, buf = bytesutil.Uint16BE(buf[:2]), buf[2:]
+		if len(buf) < int(valueSize) {
+			return nil, buf, io.ErrUnexpectedEOF
+		}
+		var value string
+		value, buf = string(buf[:valueSize]), buf[valueSize:]
+		headers[name] = value
+	}
+
+	return headers, buf, nil
+}
@@ -1,41 +1,174 @@
 package streaming_rpc
 
 import (
-	"errors"
-	"fmt"
 	"io"
+	"sync"
 )
 
-type pipeReader struct {
-	*io.PipeReader
+var _ io.ReadCloser = (*streamReader)(nil)
+
+// streamReader buffers the data received over a stream until it is read. The peer may not
+// send more than StreamWindowSize bytes ahead of the reader, such that the buffer is bounded
+// and writing to it never blocks.
+type streamReader struct {
+	mu   sync.Mutex
+	cond sync.Cond
+
+	buf []byte
+	off int // offset of the first unread byte in buf
+
+	err    error // returned once all of buf has been read
+	closed bool  // closed by the reader; data received from now on is discarded
+
+	release func(n int) // called with the number of bytes read or discarded
+}
+
+func newStreamReader(release func(n int)) *streamReader {
+	r := &streamReader{release: release}
+	r.cond.L = &r.mu
+	return r
+}
+
+func (r *streamReader) Read(buf []byte) (int, error) {
+	r.mu.Lock()
+
+	for r.off == len(r.buf) && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+
+	if r.closed {
+		r.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	if r.off == len(r.buf) {
+		err := r.err
+		r.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(buf, r.buf[r.off:])
+	r.off += n
+	if r.off == len(r.buf) {
+		r.buf, r.off = r.buf[:0], 0
+	}
+
+	r.mu.Unlock()
+
+	r.release(n)
+
+	return n, nil
+}
+
+// Close discards all buffered data, and all data received from now on.
+func (r *streamReader) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	n := len(r.buf) - r.off
+	r.buf, r.off, r.closed = nil, 0, true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	r.release(n)
+
+	return nil
+}
+
+// write buffers data received over the stream. It fails with ErrFlowControl if the peer sent
+// more data than the reader granted it.
+func (r *streamReader) write(data []byte) error {
+	r.mu.Lock()
+
+	if r.closed || r.err != nil {
+		r.mu.Unlock()
+		r.release(len(data))
+		return nil
+	}
+
+	if len(r.buf)-r.off+len(data) > StreamWindowSize {
+		r.mu.Unlock()
+		return ErrFlowControl
+	}
+
+	if r.off > 0 && len(r.buf)+len(data) > cap(r.buf) {
+		r.buf = r.buf[:copy(r.buf, r.buf[r.off:])]
+		r.off = 0
+	}
+	r.buf = append(r.buf, data...)
+
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	return nil
 }
 
-func (r *pipeReader) Read(buf []byte) (n int, err error) {
-	n, err = r.PipeReader.Read(buf)
-	if err != nil && errors.Is(err, io.ErrClosedPipe) {
-		err = io.EOF
+// closeWithError makes reads fail with err. Buffered data is still read before reads fail with
+// io.EOF, while it is discarded for any other error.
+func (r *streamReader) closeWithError(err error) {
+	r.mu.Lock()
+
+	if r.err != nil && r.err != io.EOF {
+		r.mu.Unlock()
+		return
 	}
-	return n, err
+	r.err = err
+
+	n := 0
+	if err != io.EOF {
+		n = len(r.buf) - r.off
+		r.buf, r.off = nil, 0
+	}
+
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	r.release(n)
 }
 
-type pipeWriter struct {
-	*io.PipeWriter
+var _ io.WriteCloser = (*streamWriter)(nil)
+
+// streamWriter sends data over a stream, blocking while the peer has not granted enough of
+// the windows of the stream and connection.
+type streamWriter struct {
+	provider *Provider
+	stream   *Stream
+
+	mu     sync.Mutex
+	closed bool
 }
 
-func (w *pipeWriter) Write(buf []byte) (n int, err error) {
-	n, err = w.PipeWriter.Write(buf)
-	if err != nil && errors.Is(err, io.ErrClosedPipe) {
-		err = fmt.Errorf("%s: %w", err, io.EOF)
+func (w *streamWriter) Write(buf []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, io.ErrClosedPipe
 	}
-	return n, err
+
+	return w.provider.writeData(w.stream, buf)
+}
+
+// Close sends the end of the stream to the peer.
+func (w *streamWriter) Close() error {
+	return w.closeWithTrailers(nil)
 }
 
-// createWrappedPipe wraps around a reader/writer pair from io.Pipe() such that all
-// errors reported by such reader/writer pair that comprise of io.ErrClosedPipe
-// will be wrapped with io.EOF.
-func createWrappedPipe() (*pipeReader, *pipeWriter) {
-	r, w := io.Pipe()
-	pr := &pipeReader{PipeReader: r}
-	pw := &pipeWriter{PipeWriter: w}
-	return pr, pw
+// closeWithTrailers sends the end of the stream to the peer, along with the given trailers.
+func (w *streamWriter) closeWithTrailers(trailers map[string]string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if err := w.stream.Err(); err != nil {
+		return err
+	}
+
+	return w.provider.closeSend(w.stream, trailers)
 }
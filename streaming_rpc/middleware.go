@@ -0,0 +1,190 @@
+package streaming_rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware intercepts the streams and calls handled by a StreamNode, and the pushes and calls
+// it sends out. Either of its funcs may be nil.
+type Middleware struct {
+	// Handler wraps the handlers of the services of the node.
+	Handler func(next Handler) Handler
+
+	// Invoker wraps the pushes and calls sent out with Push, PushContext, Call and Invoke.
+	Invoker func(next Invoker) Invoker
+}
+
+// Invoker sends out a push or call, and fills in its response.
+type Invoker func(ctx context.Context, inv *Invocation) error
+
+// Invocation is a push or call sent out by a StreamNode.
+type Invocation struct {
+	Services []string // services the push is made to, or the single service called
+	Headers  map[string]string
+	Unary    bool // made with Call rather than Push
+
+	Body    io.ReadCloser // body of a push
+	Request []byte        // request of a call
+
+	Stream          *Stream           // stream of a push, once its response header was read
+	Response        []byte            // response of a call
+	ResponseHeaders map[string]string // response headers and trailers of a call
+}
+
+// Service returns the names of the services of the invocation separated by commas.
+func (inv *Invocation) Service() string {
+	return strings.Join(inv.Services, ",")
+}
+
+// Use adds middleware to the node. The first middleware added is the outermost one. Use may be
+// called at any time, though requests that are already being handled or sent out are not
+// affected by it.
+func (n *StreamNode) Use(middleware ...Middleware) {
+	n.middlewareMu.Lock()
+	defer n.middlewareMu.Unlock()
+
+	n.middleware = append(n.middleware, middleware...)
+
+	n.invoker = n.invoke
+	for i := len(n.middleware) - 1; i >= 0; i-- {
+		if n.middleware[i].Invoker != nil {
+			n.invoker = n.middleware[i].Invoker(n.invoker)
+		}
+	}
+
+	if atomic.LoadUint32(&n.sealed) == 1 {
+		n.buildHandlers()
+	}
+}
+
+// buildHandlers wraps the handlers of all services of the node with its middleware, such that
+// the chain of middleware is not rebuilt for every stream. Panics are always recovered from, as
+// with Recover, to not have a single handler crash the whole process. It must be called with
+// the middleware lock of the node held.
+func (n *StreamNode) buildHandlers() {
+	handlers := make(map[string]Handler, len(n.Services))
+	for service, handler := range n.Services {
+		for i := len(n.middleware) - 1; i >= 0; i-- {
+			if n.middleware[i].Handler != nil {
+				handler = n.middleware[i].Handler(handler)
+			}
+		}
+		handlers[service] = recoverHandler(handler)
+	}
+	n.handlers = handlers
+}
+
+// handler returns the handler of service, wrapped by the middleware of the node.
+func (n *StreamNode) handler(service string) (Handler, bool) {
+	n.middlewareMu.RLock()
+	defer n.middlewareMu.RUnlock()
+
+	handler, exists := n.handlers[service]
+	return handler, exists
+}
+
+// getInvoker returns the Invoker that sends out pushes and calls through the middleware of the
+// node.
+func (n *StreamNode) getInvoker() Invoker {
+	n.middlewareMu.RLock()
+	defer n.middlewareMu.RUnlock()
+
+	if n.invoker == nil {
+		return n.invoke
+	}
+	return n.invoker
+}
+
+// invoke is the innermost Invoker, which sends inv to a random provider of its services.
+func (n *StreamNode) invoke(ctx context.Context, inv *Invocation) (err error) {
+	if inv.Unary {
+		inv.Response, inv.ResponseHeaders, err = n.call(ctx, inv.Services[0], inv.Headers, inv.Request)
+		return err
+	}
+	inv.Stream, err = n.pushContext(ctx, inv.Services, inv.Headers, inv.Body)
+	return err
+}
+
+// Recover returns a Middleware that recovers handlers from panics, logs them along with their
+// stack trace, and responds with StatusInternal. Handlers are always recovered from panics
+// before any middleware is run: Recover only needs to be used for middleware added before it,
+// such as AccessLog, to observe the status panics are responded to with.
+func Recover() Middleware {
+	return Middleware{Handler: recoverHandler}
+}
+
+func recoverHandler(next Handler) Handler {
+	return func(ctx *Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Handler for service %s panicked: %v\n%s", ctx.Service, r, debug.Stack())
+				err = NewStatusError(StatusInternal, fmt.Sprintf("panic: %v", r))
+			}
+		}()
+		return next(ctx)
+	}
+}
+
+// AccessLog returns a Middleware that logs the status of every stream and call handled or sent
+// out, along with how long it took. If logger is nil, the standard logger is used.
+func AccessLog(logger *log.Logger) Middleware {
+	printf := log.Printf
+	if logger != nil {
+		printf = logger.Printf
+	}
+
+	return Timing(
+		func(ctx *Context, elapsed time.Duration, err error) {
+			printf("Handled %s from %s: %s (%s)", ctx.Service, ctx.Conn().RemoteAddr(), statusOf(err), elapsed)
+		},
+		func(inv *Invocation, elapsed time.Duration, err error) {
+			printf("Sent %s: %s (%s)", inv.Service(), statusOf(err), elapsed)
+		},
+	)
+}
+
+// Timing returns a Middleware that reports to handled how long handlers took to handle streams
+// and calls, and to sent how long pushes and calls sent out took to be responded to. Either may
+// be nil.
+func Timing(handled func(ctx *Context, elapsed time.Duration, err error), sent func(inv *Invocation, elapsed time.Duration, err error)) Middleware {
+	var m Middleware
+
+	if handled != nil {
+		m.Handler = func(next Handler) Handler {
+			return func(ctx *Context) error {
+				start := time.Now()
+				err := next(ctx)
+				handled(ctx, time.Since(start), err)
+				return err
+			}
+		}
+	}
+
+	if sent != nil {
+		m.Invoker = func(next Invoker) Invoker {
+			return func(ctx context.Context, inv *Invocation) error {
+				start := time.Now()
+				err := next(ctx, inv)
+				sent(inv, time.Since(start), err)
+				return err
+			}
+		}
+	}
+
+	return m
+}
+
+// statusOf returns the status code err maps to, which is StatusOK if err is nil.
+func statusOf(err error) StatusCode {
+	if status := ErrorStatus(err); status != nil {
+		return status.Code
+	}
+	return StatusOK
+}
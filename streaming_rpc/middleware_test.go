@@ -0,0 +1,147 @@
+package streaming_rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lithdew/kademlia"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestStreamNodeMiddleware(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var order []string
+
+	trace := func(name string) Middleware {
+		return Middleware{
+			Handler: func(next Handler) Handler {
+				return func(ctx *Context) error {
+					order = append(order, name)
+					return next(ctx)
+				}
+			},
+			Invoker: func(next Invoker) Invoker {
+				return func(ctx context.Context, inv *Invocation) error {
+					order = append(order, name)
+					inv.Headers = map[string]string{"traced": name}
+					return next(ctx, inv)
+				}
+			},
+		}
+	}
+
+	var logs bytes.Buffer
+
+	services := map[string]Handler{
+		"traced": func(ctx *Context) error {
+			_, err := ctx.Write([]byte(ctx.Headers["traced"]))
+			return err
+		},
+		"panic": func(ctx *Context) error {
+			panic("boom")
+		},
+	}
+
+	sk := GenerateSecretKey()
+
+	server := NewStreamNode(sk, nil, kademlia.NewTable(sk.Public()))
+	server.Services = services
+	server.Use(AccessLog(log.New(&logs, "", 0)), Recover(), trace("outer"), trace("inner"))
+
+	require.NoError(t, server.Listen("127.0.0.1:0"))
+
+	go func() {
+		require.NoError(t, server.Serve())
+	}()
+
+	client := newTestNode(t, nil)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	require.NoError(t, client.ProbeWithAddr(server.Addrs()[0].String()))
+
+	var elapsed []time.Duration
+
+	client.Use(trace("client"), Timing(nil, func(inv *Invocation, d time.Duration, err error) {
+		elapsed = append(elapsed, d)
+	}))
+
+	// middleware is run in the order it was added, on both sides
+
+	res, _, err := client.Call(context.Background(), "traced", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "client", string(res))
+	require.Equal(t, []string{"client", "outer", "inner"}, order)
+	require.Len(t, elapsed, 1)
+
+	stream, err := client.Push([]string{"traced"}, nil, ioutil.NopCloser(strings.NewReader("")))
+	require.NoError(t, err)
+	res, err = ioutil.ReadAll(stream.Reader)
+	require.NoError(t, err)
+	require.Equal(t, "client", string(res))
+	require.Len(t, elapsed, 2)
+
+	// panics are recovered from, and responded to with an internal error
+
+	var status *StatusError
+
+	_, _, err = client.Call(context.Background(), "panic", nil, nil)
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusInternal, status.Code)
+
+	_, err = client.Push([]string{"panic"}, nil, ioutil.NopCloser(strings.NewReader("")))
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusInternal, status.Code)
+
+	require.Contains(t, logs.String(), "Handled traced from ")
+	require.Contains(t, logs.String(), "Handled panic from ")
+	require.Contains(t, logs.String(), ": Internal (")
+}
+
+func TestStreamNodeRecoversByDefault(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	services := map[string]Handler{
+		"panic": func(ctx *Context) error {
+			panic("boom")
+		},
+		"ok": func(ctx *Context) error {
+			return nil
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	var status *StatusError
+
+	_, _, err := client.Call(context.Background(), "panic", nil, nil)
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusInternal, status.Code)
+	require.Equal(t, "panic: boom", status.Message)
+
+	// middleware added once the node is serving applies to streams handled afterwards
+
+	var handled []string
+
+	server.Use(Timing(func(ctx *Context, elapsed time.Duration, err error) {
+		handled = append(handled, ctx.Service)
+	}, nil))
+
+	_, err = client.Push([]string{"panic"}, nil, ioutil.NopCloser(strings.NewReader("")))
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusInternal, status.Code)
+
+	_, _, err = client.Call(context.Background(), "ok", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ok"}, handled)
+}
@@ -1,6 +1,8 @@
 package streaming_rpc
 
 import (
+	"math"
+	"strings"
 	"testing"
 	"testing/quick"
 
@@ -26,11 +28,96 @@ func TestServiceResponsePacket(t *testing.T) {
 	require.NoError(t, quick.Check(f, nil))
 }
 
+func TestServiceResponsePacketLongMessage(t *testing.T) {
+	message, details := strings.Repeat("a", math.MaxUint16+1), make([]byte, math.MaxUint16+1)
+
+	packet := ServiceResponsePacket{
+		StreamId: 1,
+		Status:   StatusInternal,
+		Message:  message,
+		Details:  details,
+		Headers:  map[string]string{"key": "value"},
+	}
+
+	actual, err := UnmarshalServiceResponsePacket(packet.AppendTo(nil))
+	require.NoError(t, err)
+	require.Equal(t, message[:math.MaxUint16], actual.Message)
+	require.Equal(t, details[:math.MaxUint16], actual.Details)
+	require.Equal(t, packet.Headers, actual.Headers)
+}
+
 func TestDataPacket(t *testing.T) {
 	var dst []byte
 	f := func(expected DataPacket) bool {
+		if len(expected.Trailers) == 0 {
+			expected.Trailers = nil
+		}
 		actual, err := UnmarshalDataPacket(expected.AppendTo(dst[:0]))
 		return assert.NoError(t, err) && assert.EqualValues(t, expected, actual)
 	}
 	require.NoError(t, quick.Check(f, nil))
 }
+
+func TestWindowUpdatePacket(t *testing.T) {
+	var dst []byte
+	f := func(expected WindowUpdatePacket) bool {
+		actual, err := UnmarshalWindowUpdatePacket(expected.AppendTo(dst[:0]))
+		return assert.NoError(t, err) && assert.EqualValues(t, expected, actual)
+	}
+	require.NoError(t, quick.Check(f, nil))
+}
+
+func TestResetPacket(t *testing.T) {
+	var dst []byte
+	f := func(expected ResetPacket) bool {
+		actual, err := UnmarshalResetPacket(expected.AppendTo(dst[:0]))
+		return assert.NoError(t, err) && assert.EqualValues(t, expected, actual)
+	}
+	require.NoError(t, quick.Check(f, nil))
+}
+
+func TestResetPacketLongMessage(t *testing.T) {
+	message := strings.Repeat("a", math.MaxUint16+1)
+
+	actual, err := UnmarshalResetPacket(ResetPacket{StreamID: 1, Message: message}.AppendTo(nil))
+	require.NoError(t, err)
+	require.Equal(t, message[:math.MaxUint16], actual.Message)
+}
+
+func TestCallRequestPacket(t *testing.T) {
+	var dst []byte
+	f := func(expected CallRequestPacket) bool {
+		actual, err := UnmarshalCallRequestPacket(expected.AppendTo(dst[:0]))
+		return assert.NoError(t, err) && assert.EqualValues(t, expected, actual)
+	}
+	require.NoError(t, quick.Check(f, nil))
+}
+
+func TestCallResponsePacket(t *testing.T) {
+	var dst []byte
+	f := func(expected CallResponsePacket) bool {
+		actual, err := UnmarshalCallResponsePacket(expected.AppendTo(dst[:0]))
+		return assert.NoError(t, err) && assert.EqualValues(t, expected, actual)
+	}
+	require.NoError(t, quick.Check(f, nil))
+}
+
+func TestCallResponsePacketLongMessage(t *testing.T) {
+	message, details := strings.Repeat("a", math.MaxUint16+1), make([]byte, math.MaxUint16+1)
+
+	packet := CallResponsePacket{
+		StreamID: 1,
+		Status:   StatusInternal,
+		Message:  message,
+		Details:  details,
+		Headers:  map[string]string{"key": "value"},
+		Body:     []byte("body"),
+	}
+
+	actual, err := UnmarshalCallResponsePacket(packet.AppendTo(nil))
+	require.NoError(t, err)
+	require.Equal(t, message[:math.MaxUint16], actual.Message)
+	require.Equal(t, details[:math.MaxUint16], actual.Details)
+	require.Equal(t, packet.Headers, actual.Headers)
+	require.Equal(t, packet.Body, actual.Body)
+}
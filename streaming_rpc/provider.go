@@ -1,12 +1,14 @@
 package streaming_rpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	st "github.com/TheSmallBoat/carlo/streaming_transmit"
 	"github.com/lithdew/kademlia"
@@ -19,29 +21,39 @@ type Provider struct {
 
 	services map[string]struct{}
 
+	window *window // bytes that may still be sent over all streams
+
 	mu      sync.Mutex         // protects all stream-related structures
 	counter uint32             // total number of outgoing streams
 	streams map[uint32]*Stream // maps stream ids to stream instances
+	unacked int                // bytes read from all streams but not yet granted back to the peer
 }
 
-func (p *Provider) NextStream() *Stream {
-	reader, writer := createWrappedPipe()
+// newStream creates a stream with the given id. It must be called with the lock held.
+func (p *Provider) newStream(id uint32) *Stream {
+	stream := &Stream{
+		ID:       id,
+		provider: p,
+		window:   newWindow(StreamWindowSize),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	stream.Reader = newStreamReader(func(n int) { p.release(stream, n) })
+	stream.Writer = &streamWriter{provider: p, stream: stream}
+	stream.wg.Add(1)
+	p.streams[id] = stream
+
+	return stream
+}
 
+func (p *Provider) NextStream() *Stream {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	id := p.counter
 	p.counter += 2
 
-	stream := &Stream{
-		ID:     id,
-		Reader: reader,
-		Writer: writer,
-	}
-	stream.wg.Add(1)
-	p.streams[id] = stream
-
-	return stream
+	return p.newStream(id)
 }
 
 func (p *Provider) GetStream(id uint32) (*Stream, bool) {
@@ -53,59 +65,230 @@ func (p *Provider) GetStream(id uint32) (*Stream, bool) {
 }
 
 func (p *Provider) RegisterStreamWithServiceRequestPacket(header ServiceRequestPacket) (*Stream, bool) {
-	reader, writer := createWrappedPipe()
+	return p.registerStream(header.StreamId)
+}
 
+// registerStream creates a stream opened by the peer with the given id. It reports false if
+// a stream with the given id exists already.
+func (p *Provider) registerStream(id uint32) (*Stream, bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	stream, exists := p.streams[header.StreamId]
+	stream, exists := p.streams[id]
 	if exists {
 		return stream, false
 	}
 
-	stream = &Stream{
-		ID:     header.StreamId,
-		Reader: reader,
-		Writer: writer,
+	return p.newStream(id), true
+}
+
+func (p *Provider) CloseStreamWithError(stream *Stream, err error) {
+	p.mu.Lock()
+	if stream.err == nil {
+		stream.err = err
+		close(stream.done)
 	}
-	stream.wg.Add(1)
-	p.streams[header.StreamId] = stream
+	stream.once.Do(stream.wg.Done)
+
+	stream.sendDone, stream.recvDone = true, true
+	p.forgetStream(stream)
+	p.mu.Unlock()
 
-	return stream, true
+	// buffered data is discarded and granted back to the peer, which requires the lock
+
+	stream.Reader.closeWithError(err)
+	stream.window.close(err)
 }
 
-func (p *Provider) CloseStreamWithError(stream *Stream, err error) {
+// resetStream closes the stream with err, and tells the peer to close it with a ResetError of
+// the given code and message. Streams that were already closed are left as they are.
+func (p *Provider) resetStream(stream *Stream, code ResetCode, message string, err error) {
+	p.mu.Lock()
+	open := p.streams[stream.ID] == stream
+	p.mu.Unlock()
+
+	if !open {
+		return
+	}
+
+	packet := ResetPacket{
+		StreamID: stream.ID,
+		Code:     code,
+		Message:  message,
+	}
+
+	_ = p.conn.SendNoWait(packet.AppendTo([]byte{OpCodeReset}))
+
+	p.CloseStreamWithError(stream, err)
+}
+
+// forgetStream removes the stream from the streams of the provider. It must be called with the
+// lock held.
+func (p *Provider) forgetStream(stream *Stream) {
+	if p.streams[stream.ID] == stream {
+		delete(p.streams, stream.ID)
+		close(stream.closed)
+	}
+}
+
+// finishSend marks that all data of the stream has been sent, and finishRecv that all data of
+// the stream has been received. Streams are forgotten once both are done.
+func (p *Provider) finishSend(stream *Stream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream.sendDone = true
+	if stream.recvDone {
+		p.forgetStream(stream)
+	}
+}
+
+func (p *Provider) finishRecv(stream *Stream, trailers map[string]string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	_ = stream.Reader.CloseWithError(err)
-	_ = stream.Writer.CloseWithError(err)
+	stream.Trailer = trailers
+
+	stream.Reader.closeWithError(io.EOF)
 
 	stream.once.Do(stream.wg.Done)
 
-	delete(p.streams, stream.ID)
+	stream.recvDone = true
+	if stream.sendDone {
+		p.forgetStream(stream)
+	}
 }
 
 func (p *Provider) Close() {
+	err := fmt.Errorf("provider connection closed: %w", io.EOF)
+
+	p.window.close(err)
+
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	streams := make([]*Stream, 0, len(p.streams))
+	for _, stream := range p.streams {
+		streams = append(streams, stream)
+	}
+	p.mu.Unlock()
 
-	for sid, stream := range p.streams {
-		err := fmt.Errorf("provider connection closed: %w", io.EOF)
+	for _, stream := range streams {
+		p.CloseStreamWithError(stream, err)
+	}
+}
 
-		_ = stream.Reader.CloseWithError(err)
-		_ = stream.Writer.CloseWithError(err)
+// release grants the peer n more bytes to send over the stream once they were read from it or
+// discarded, or n more bytes to send over the connection if the stream is nil. Grants are held
+// back until they make up for at least half of a window.
+func (p *Provider) release(stream *Stream, n int) {
+	if n <= 0 {
+		return
+	}
 
-		stream.once.Do(stream.wg.Done)
+	var streamIncrement, connIncrement int
 
-		delete(p.streams, sid)
+	p.mu.Lock()
+	if stream != nil && !stream.recvDone {
+		stream.unacked += n
+		if stream.unacked >= StreamWindowSize/2 {
+			streamIncrement, stream.unacked = stream.unacked, 0
+		}
+	}
+	p.unacked += n
+	if p.unacked >= ConnWindowSize/2 {
+		connIncrement, p.unacked = p.unacked, 0
+	}
+	p.mu.Unlock()
+
+	if streamIncrement > 0 {
+		p.sendWindowUpdate(stream.ID, streamIncrement)
+	}
+	if connIncrement > 0 {
+		p.sendWindowUpdate(connStreamID, connIncrement)
 	}
 }
 
+func (p *Provider) sendWindowUpdate(id uint32, increment int) {
+	packet := WindowUpdatePacket{
+		StreamID:  id,
+		Increment: uint32(increment),
+	}
+
+	_ = p.conn.SendNoWait(packet.AppendTo([]byte{OpCodeWindowUpdate}))
+}
+
+// writeData sends data over the stream in chunks of at most ChunkSize bytes. It blocks while
+// the peer has not granted enough of the windows of the stream and connection.
+func (p *Provider) writeData(stream *Stream, data []byte) (int, error) {
+	written := 0
+
+	for written < len(data) {
+		size := len(data) - written
+		if size > ChunkSize {
+			size = ChunkSize
+		}
+
+		size, err := stream.window.take(size)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := p.window.take(size)
+		if err != nil {
+			return written, err
+		}
+		if n < size {
+			stream.window.add(size - n)
+		}
+
+		packet := DataPacket{
+			StreamID: stream.ID,
+			Data:     data[written : written+n],
+		}
+
+		if err := p.conn.Send(packet.AppendTo([]byte{OpCodeData})); err != nil {
+			return written, err
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+// closeSend sends the end of the stream to the peer, along with the given trailers.
+func (p *Provider) closeSend(stream *Stream, trailers map[string]string) error {
+	packet := DataPacket{
+		StreamID: stream.ID,
+		Trailers: trailers,
+	}
+
+	err := p.conn.Send(packet.AppendTo([]byte{OpCodeData}))
+	if err != nil {
+		return err
+	}
+
+	p.finishSend(stream)
+
+	return nil
+}
+
 var ErrProviderNotAvailable = errors.New("provider unable to provide service")
 
-func (p *Provider) Push(services []string, headers map[string]string, body io.ReadCloser) (*Stream, error) {
-	buf := make([]byte, ChunkSize)
+// OpenStream opens a stream to the provider for the given services. Data written to the
+// Writer of the stream is sent while the response is read from its Reader, such that either
+// may proceed concurrently with the other, and each may be closed on its own.
+func (p *Provider) OpenStream(services []string, headers map[string]string) (*Stream, error) {
+	return p.openStream(context.Background(), services, headers)
+}
+
+// openStream opens a stream that is canceled once ctx is done. If ctx has a deadline, the time
+// left until it passes is sent to the provider as the TimeoutHeader.
+func (p *Provider) openStream(ctx context.Context, services []string, headers map[string]string) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	headers = withTimeout(ctx, headers)
 
 	stream := p.NextStream()
 
@@ -122,41 +305,121 @@ func (p *Provider) Push(services []string, headers map[string]string, body io.Re
 		return nil, err
 	}
 
+	if ctx.Done() != nil {
+		go stream.cancelWhenDone(ctx)
+	}
+
+	return stream, nil
+}
+
+// withTimeout returns a copy of headers with the TimeoutHeader set to the time left until the
+// deadline of ctx passes, or headers as they are if ctx has no deadline.
+func withTimeout(ctx context.Context, headers map[string]string) map[string]string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return headers
+	}
+
+	copied := make(map[string]string, len(headers)+1)
+	for key, val := range headers {
+		copied[key] = val
+	}
+	copied[TimeoutHeader] = time.Until(deadline).String()
+
+	return copied
+}
+
+var errNilBody = errors.New("push body must not be nil")
+
+// Push sends body to the provider for the given services, and returns once the response header
+// was received. Push does not wait for body to be sent in full: it keeps being sent in the
+// background while the response is read, and is closed once it was, or once the stream failed.
+// Failing to read body resets the stream, such that reading the response fails with the error
+// body failed with. Body is closed as well if the push fails.
+func (p *Provider) Push(services []string, headers map[string]string, body io.ReadCloser) (*Stream, error) {
+	return p.PushContext(context.Background(), services, headers, body)
+}
+
+// PushContext is like Push, but cancels the stream once ctx is done, up until the response has
+// been received in full. The deadline of ctx is propagated to the handler of the provider.
+func (p *Provider) PushContext(ctx context.Context, services []string, headers map[string]string, body io.ReadCloser) (*Stream, error) {
+	if body == nil {
+		return nil, errNilBody
+	}
+
+	stream, err := p.openStream(ctx, services, headers)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return p.push(stream, body)
+}
+
+// push sends body over stream, and waits for the response header of the stream. If no response
+// header was received, the stream is closed and push waits for body to stop being sent.
+func (p *Provider) push(stream *Stream, body io.ReadCloser) (*Stream, error) {
+	written := make(chan struct{})
+
+	go func() {
+		defer close(written)
+		p.writeBody(stream, body)
+	}()
+
+	if _, err := stream.ReadHeader(); err != nil {
+		p.CloseStreamWithError(stream, err)
+		<-written
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// writeBody writes body to stream, and closes the writing side of the stream. It runs alongside
+// the response being read, as a handler may respond before it has read the body in full, and
+// may not read any further until its response is read. Body is closed once it was written, or
+// once the stream failed, such that reads from body blocking on the stream are unblocked.
+func (p *Provider) writeBody(stream *Stream, body io.ReadCloser) {
+	var once sync.Once
+	closeBody := func() { once.Do(func() { body.Close() }) }
+
+	finished := make(chan struct{})
+	defer close(finished)
+	defer closeBody()
+
+	go func() {
+		select {
+		case <-stream.done:
+			closeBody()
+		case <-finished:
+		}
+	}()
+
+	buf := make([]byte, ChunkSize)
+
 	for {
 		nn, err := body.Read(buf[:ChunkSize])
 		if err != nil && err != io.EOF {
 			err = fmt.Errorf("failed reading body: %w", err)
-			p.CloseStreamWithError(stream, err)
-			return nil, err
+			p.resetStream(stream, ResetCanceled, err.Error(), err)
+			return
 		}
 
-		payload := DataPacket{
-			StreamID: stream.ID,
-			Data:     buf[:nn],
-		}
-
-		if err := p.conn.Send(payload.AppendTo([]byte{OpCodeData})); err != nil {
+		if _, err := stream.Writer.Write(buf[:nn]); err != nil {
 			err = fmt.Errorf("failed writing body chunk as a data packet to peer: %w", err)
-			p.CloseStreamWithError(stream, err)
-			return nil, err
+			p.resetStream(stream, ResetCanceled, err.Error(), err)
+			return
 		}
 
-		if err == io.EOF && nn == 0 {
+		if err == io.EOF {
 			break
 		}
 	}
 
-	stream.wg.Wait()
-
-	if stream.Header == nil {
-		return nil, fmt.Errorf("no response headers were returned: %w", io.EOF)
-	}
-
-	if !stream.Header.Handled {
-		return nil, fmt.Errorf("provider unable to service: %s", services)
+	if err := stream.CloseWrite(); err != nil {
+		err = fmt.Errorf("failed writing body chunk as a data packet to peer: %w", err)
+		p.resetStream(stream, ResetCanceled, err.Error(), err)
 	}
-
-	return stream, nil
 }
 
 func (p *Provider) Services() []string {
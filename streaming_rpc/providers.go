@@ -60,6 +60,7 @@ func (p *Providers) registerProvider(conn *st.Conn, id *kademlia.ID, services []
 		provider = &Provider{
 			services: make(map[string]struct{}),
 			streams:  make(map[uint32]*Stream),
+			window:   newWindow(ConnWindowSize),
 		}
 		if outgoing {
 			provider.counter = 1
@@ -0,0 +1,157 @@
+package streaming_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync/atomic"
+)
+
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Register registers the exported methods of rcvr that are of the shape
+//
+//	func(ctx context.Context, req *Req) (*Resp, error)
+//
+// as services named "service/Method". Requests and responses are decoded and encoded with the
+// Codec named by their ContentTypeHeader. Errors returned by methods are sent back to callers
+// as a *StatusError, as with any Handler. Methods of any other shape are skipped.
+//
+// As the services of a node are advertised to peers as it connects to them, Register must be
+// called before the node is started with Start or Listen, and before it connects to any peer.
+func (n *StreamNode) Register(service string, rcvr interface{}) error {
+	if atomic.LoadUint32(&n.sealed) == 1 {
+		return errors.New("services must be registered before the node is started or connects to any peer")
+	}
+	if rcvr == nil {
+		return errors.New("cannot register methods of a nil receiver")
+	}
+
+	val := reflect.ValueOf(rcvr)
+	typ := val.Type()
+
+	handlers := make(map[string]Handler)
+
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		if method.PkgPath != "" {
+			continue
+		}
+
+		fn := val.Method(i)
+		if !isServiceMethod(fn.Type()) {
+			continue
+		}
+
+		handlers[service+"/"+method.Name] = methodHandler(fn)
+	}
+
+	if len(handlers) == 0 {
+		return fmt.Errorf("type %s has no exported methods of the shape func(context.Context, *Req) (*Resp, error)", typ)
+	}
+
+	if n.Services == nil {
+		n.Services = make(map[string]Handler, len(handlers))
+	}
+	for name, handler := range handlers {
+		n.Services[name] = handler
+	}
+
+	return nil
+}
+
+// seal prevents any more services from being registered, as they are about to be advertised,
+// and wraps their handlers with the middleware of the node.
+func (n *StreamNode) seal() {
+	if !atomic.CompareAndSwapUint32(&n.sealed, 0, 1) {
+		return
+	}
+
+	n.middlewareMu.Lock()
+	defer n.middlewareMu.Unlock()
+
+	n.buildHandlers()
+}
+
+func isServiceMethod(typ reflect.Type) bool {
+	if typ.NumIn() != 2 || typ.NumOut() != 2 {
+		return false
+	}
+	if typ.In(0) != typeOfContext || typ.In(1).Kind() != reflect.Ptr {
+		return false
+	}
+	if typ.Out(0).Kind() != reflect.Ptr || typ.Out(1) != typeOfError {
+		return false
+	}
+	return true
+}
+
+// methodHandler returns a Handler that decodes requests for fn, and encodes its responses.
+func methodHandler(fn reflect.Value) Handler {
+	reqType := fn.Type().In(1).Elem()
+
+	return func(ctx *Context) error {
+		codec, exists := codecFor(ctx.Headers[ContentTypeHeader])
+		if !exists {
+			return NewStatusError(StatusInvalidArgument,
+				fmt.Sprintf("unsupported content type '%s'", ctx.Headers[ContentTypeHeader]))
+		}
+
+		body, err := ioutil.ReadAll(ctx.Body)
+		if err != nil {
+			return err
+		}
+
+		req := reflect.New(reqType)
+		if err := codec.Unmarshal(body, req.Interface()); err != nil {
+			return NewStatusError(StatusInvalidArgument, fmt.Sprintf("failed to decode request: %s", err))
+		}
+
+		out := fn.Call([]reflect.Value{reflect.ValueOf(ctx.Context()), req})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return err
+		}
+
+		res, err := codec.Marshal(out[0].Interface())
+		if err != nil {
+			return fmt.Errorf("failed to encode response: %w", err)
+		}
+
+		ctx.WriteHeader(ContentTypeHeader, codec.Name())
+
+		_, err = ctx.Write(res)
+		return err
+	}
+}
+
+// Invoke calls the method registered under the given "service/Method" name by a provider with
+// Register. req is encoded with the Codec of the node, and the response is decoded into resp.
+func (n *StreamNode) Invoke(ctx context.Context, method string, req, resp interface{}) error {
+	codec := n.getCodec()
+
+	body, err := codec.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	res, headers, err := n.Call(ctx, method, map[string]string{ContentTypeHeader: codec.Name()}, body)
+	if err != nil {
+		return err
+	}
+
+	codec, exists := codecFor(headers[ContentTypeHeader])
+	if !exists {
+		return fmt.Errorf("unsupported content type '%s' of response", headers[ContentTypeHeader])
+	}
+
+	if err := codec.Unmarshal(res, resp); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
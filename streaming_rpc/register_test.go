@@ -0,0 +1,77 @@
+package streaming_rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+type addRequest struct {
+	A, B int
+}
+
+type addResponse struct {
+	Sum int
+}
+
+type arith struct{}
+
+func (arith) Add(ctx context.Context, req *addRequest) (*addResponse, error) {
+	if req.A < 0 || req.B < 0 {
+		return nil, NewStatusError(StatusInvalidArgument, "negative operand")
+	}
+	return &addResponse{Sum: req.A + req.B}, nil
+}
+
+// Ignored has a shape that is not supported, and is thus not registered.
+func (arith) Ignored(a, b int) int { return a + b }
+
+func TestStreamNodeRegister(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var registry StreamNode
+	require.NoError(t, registry.Register("arith", arith{}))
+	require.Len(t, registry.Services, 1)
+	require.Contains(t, registry.Services, "arith/Add")
+
+	require.Error(t, registry.Register("empty", struct{}{}))
+	require.Error(t, registry.Register("nil", nil))
+
+	server, client := connectTestNodes(t, registry.Services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	// services may not be registered once they were advertised to peers
+
+	require.Error(t, server.Register("late", arith{}))
+	require.Error(t, client.Register("late", arith{}))
+
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		client.Codec = codec
+
+		var res addResponse
+		require.NoError(t, client.Invoke(context.Background(), "arith/Add", &addRequest{A: 1, B: 2}, &res))
+		require.Equal(t, 3, res.Sum)
+
+		var status *StatusError
+
+		err := client.Invoke(context.Background(), "arith/Add", &addRequest{A: -1, B: 2}, &res)
+		require.True(t, errors.As(err, &status), err)
+		require.Equal(t, StatusInvalidArgument, status.Code)
+	}
+
+	// requests that cannot be decoded, or are encoded with an unknown codec, are rejected
+
+	var status *StatusError
+
+	_, _, err := client.Call(context.Background(), "arith/Add", nil, []byte("{"))
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusInvalidArgument, status.Code)
+
+	_, _, err = client.Call(context.Background(), "arith/Add", map[string]string{ContentTypeHeader: "text/xml"}, nil)
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusInvalidArgument, status.Code)
+}
@@ -0,0 +1,36 @@
+package streaming_rpc
+
+import (
+	"io"
+
+	"github.com/lithdew/bytesutil"
+)
+
+type ResetPacket struct {
+	StreamID uint32    // stream id
+	Code     ResetCode // why the stream was reset
+	Message  string    // human-readable description of why the stream was reset, truncated to 64 KiB
+}
+
+func (p ResetPacket) AppendTo(dst []byte) []byte {
+	dst = bytesutil.AppendUint32BE(dst, p.StreamID)
+	dst = bytesutil.AppendUint32BE(dst, p.Code)
+	dst = appendString16(dst, p.Message)
+	return dst
+}
+
+func UnmarshalResetPacket(buf []byte) (ResetPacket, error) {
+	var packet ResetPacket
+	if len(buf) < 4+4+2 {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.StreamID, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+	packet.Code, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+	var size uint16
+	size, buf = bytesutil.Uint16BE(buf[:2]), buf[2:]
+	if uint16(len(buf)) < size {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.Message, buf = string(buf[:size]), buf[size:]
+	return packet, nil
+}
@@ -8,17 +8,15 @@ import (
 
 type ServiceResponsePacket struct {
 	StreamId uint32            // stream id
-	Handled  bool              // whether or not the service was handled
+	Status   StatusCode        // whether or not the service was handled successfully
+	Message  string            // describes why the service was not handled successfully
+	Details  []byte            // optional details on why the service was not handled successfully
 	Headers  map[string]string // headers for this packet
 }
 
 func (p ServiceResponsePacket) AppendTo(dst []byte) []byte {
 	dst = bytesutil.AppendUint32BE(dst, p.StreamId)
-	if p.Handled {
-		dst = append(dst, 1)
-	} else {
-		dst = append(dst, 0)
-	}
+	dst = appendStatus(dst, p.Status, p.Message, p.Details)
 	if p.Headers != nil {
 		dst = bytesutil.AppendUint16BE(dst, uint16(len(p.Headers)))
 		for name, value := range p.Headers {
@@ -42,7 +40,33 @@ func UnmarshalServiceResponsePacket(buf []byte) (ServiceResponsePacket, error) {
 		}
 
 		packet.StreamId, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
-		packet.Handled, buf = buf[0] == 1, buf[1:]
+		packet.Status, buf = StatusCode(buf[0]), buf[1:]
+	}
+
+	{
+		if len(buf) < 2 {
+			return packet, io.ErrUnexpectedEOF
+		}
+		var size uint16
+		size, buf = bytesutil.Uint16BE(buf[:2]), buf[2:]
+		if len(buf) < int(size) {
+			return packet, io.ErrUnexpectedEOF
+		}
+		packet.Message, buf = string(buf[:size]), buf[size:]
+	}
+
+	{
+		if len(buf) < 2 {
+			return packet, io.ErrUnexpectedEOF
+		}
+		var size uint16
+		size, buf = bytesutil.Uint16BE(buf[:2]), buf[2:]
+		if len(buf) < int(size) {
+			return packet, io.ErrUnexpectedEOF
+		}
+		packet.Details = make([]byte, size)
+		copy(packet.Details, buf[:size])
+		buf = buf[size:]
 	}
 
 	{
@@ -84,3 +108,11 @@ func UnmarshalServiceResponsePacket(buf []byte) (ServiceResponsePacket, error) {
 
 	return packet, nil
 }
+
+// statusError returns the *StatusError the response carries, or nil if its status is StatusOK.
+func (p ServiceResponsePacket) statusError() *StatusError {
+	if p.Status == StatusOK {
+		return nil
+	}
+	return &StatusError{Code: p.Status, Message: p.Message, Details: p.Details}
+}
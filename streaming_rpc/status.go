@@ -0,0 +1,82 @@
+package streaming_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// StatusCode describes the outcome of handling a stream, and is sent back to its caller in the
+// ServiceResponsePacket of the stream.
+type StatusCode uint8
+
+const (
+	StatusOK               StatusCode = iota // the stream was handled successfully
+	StatusCanceled                           // the stream was canceled
+	StatusUnknown                            // the stream failed for an unknown reason
+	StatusInvalidArgument                    // the request was malformed
+	StatusDeadlineExceeded                   // the deadline of the stream passed
+	StatusNotFound                           // the requested service or resource does not exist
+	StatusPermissionDenied                   // the caller may not make the request
+	StatusUnavailable                        // the service is temporarily unavailable
+	StatusInternal                           // the handler failed
+)
+
+var statusNames = [...]string{
+	StatusOK:               "OK",
+	StatusCanceled:         "Canceled",
+	StatusUnknown:          "Unknown",
+	StatusInvalidArgument:  "InvalidArgument",
+	StatusDeadlineExceeded: "DeadlineExceeded",
+	StatusNotFound:         "NotFound",
+	StatusPermissionDenied: "PermissionDenied",
+	StatusUnavailable:      "Unavailable",
+	StatusInternal:         "Internal",
+}
+
+func (c StatusCode) String() string {
+	if int(c) < len(statusNames) {
+		return statusNames[c]
+	}
+	return fmt.Sprintf("StatusCode(%d)", c)
+}
+
+// StatusError is an error carrying a StatusCode. Handlers may return it to have its code,
+// message and details sent to the caller, and callers get it back whenever a stream was not
+// handled successfully.
+type StatusError struct {
+	Code    StatusCode
+	Message string
+	Details []byte
+}
+
+func NewStatusError(code StatusCode, message string) *StatusError {
+	return &StatusError{Code: code, Message: message}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", e.Code, e.Message)
+}
+
+// ErrorStatus maps err to a *StatusError. Errors that are not *StatusError are mapped to
+// StatusCanceled or StatusDeadlineExceeded if they stem from a context.Context, and to
+// StatusInternal otherwise. It returns nil if err is nil.
+func ErrorStatus(err error) *StatusError {
+	if err == nil {
+		return nil
+	}
+
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return NewStatusError(StatusCanceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewStatusError(StatusDeadlineExceeded, err.Error())
+	default:
+		return NewStatusError(StatusInternal, err.Error())
+	}
+}
@@ -1,18 +1,132 @@
 package streaming_rpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
 )
 
+type ResetCode = uint32
+
+const (
+	ResetInternalError    ResetCode = iota // the stream failed for an unspecified reason
+	ResetCanceled                          // the stream is no longer needed
+	ResetFlowControlError                  // the peer sent more data than it was granted
+	ResetDeadlineExceeded                  // the deadline of the stream passed
+)
+
+var ErrStreamCanceled = errors.New("stream canceled")
+
+// ResetError is the error reads and writes over a stream fail with once it has been reset
+// with a ResetPacket.
+type ResetError struct {
+	Code    ResetCode
+	Message string
+	Remote  bool // whether the stream was reset by the peer
+}
+
+func (e *ResetError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("stream reset by peer (code %d): %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("stream reset (code %d): %s", e.Code, e.Message)
+}
+
 type Stream struct {
 	ID     uint32
-	Reader *pipeReader
-	Writer *pipeWriter
+	Reader *streamReader // data received over the stream
+	Writer *streamWriter // data sent over the stream
 
 	Header *ServiceResponsePacket
 
+	// Trailer holds the trailers sent along with the end of the stream. It is only set once
+	// Reader returned io.EOF.
+	Trailer map[string]string
+
+	provider *Provider
+	callBody []byte // response of a call, if it was received in a single packet
 	received uint64
 
+	window   *window // bytes that may still be sent over the stream
+	unacked  int     // bytes read but not yet granted back to the peer
+	sendDone bool    // all data has been sent
+	recvDone bool    // all data has been received
+
+	done   chan struct{} // closed once the stream failed
+	err    error         // why the stream failed
+	closed chan struct{} // closed once the stream is either finished or failed
+
 	wg   sync.WaitGroup
 	once sync.Once
 }
+
+// ReadHeader waits for the response header of the stream. It fails with a *StatusError if the
+// provider did not handle the stream successfully, or if the stream was closed before a
+// response header was received.
+func (s *Stream) ReadHeader() (*ServiceResponsePacket, error) {
+	s.wg.Wait()
+
+	if s.Header == nil {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no response headers were returned: %w", io.EOF)
+	}
+	if s.Header.Status != StatusOK {
+		return nil, s.Header.statusError()
+	}
+
+	return s.Header, nil
+}
+
+// CloseWrite tells the peer that no more data will be sent over the stream, while data may
+// still be received over it.
+func (s *Stream) CloseWrite() error {
+	return s.Writer.Close()
+}
+
+// CloseRead discards all data received over the stream from now on, while data may still be
+// sent over it.
+func (s *Stream) CloseRead() error {
+	return s.Reader.Close()
+}
+
+// Cancel aborts the stream, and tells the peer to stop handling it. Reads and writes over the
+// stream fail with ErrStreamCanceled from then on.
+func (s *Stream) Cancel() {
+	s.provider.resetStream(s, ResetCanceled, "canceled", ErrStreamCanceled)
+}
+
+// Done returns a channel that is closed once the stream failed, either because it was reset
+// or canceled, or because its connection was closed.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the stream failed, or nil if it has not.
+func (s *Stream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// cancelWhenDone resets the stream once ctx is done, unless the stream is closed before.
+func (s *Stream) cancelWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-s.closed:
+		return
+	}
+
+	code := ResetCanceled
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		code = ResetDeadlineExceeded
+	}
+
+	s.provider.resetStream(s, code, ctx.Err().Error(), ctx.Err())
+}
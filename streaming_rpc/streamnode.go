@@ -1,6 +1,7 @@
 package streaming_rpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -43,11 +44,33 @@ type StreamNode struct {
 	Srv       *st.Server
 	providers *Providers
 
-	// A mapping of service names to their respective handlers.
+	// A mapping of service names to their respective handlers. It is advertised to peers, and
+	// must not be modified once the node is started or connects to any peer.
 	Services map[string]Handler
 
+	// Codec encodes requests made with Invoke. If nil, DefaultCodec is used.
+	Codec Codec
+
+	middlewareMu sync.RWMutex
+	middleware   []Middleware
+	handlers     map[string]Handler // Services wrapped by middleware, once sealed
+	invoker      Invoker            // invoke wrapped by middleware
+
+	sealed uint32 // set once Services are advertised to peers, after which Register fails
+
 	clientsMu sync.Mutex
 	clients   map[string]*st.Client
+
+	// PublicAddr is the host:port address peers reach this node at, e.g. when it is behind a
+	// NAT or load balancer. If empty, the address of the first listener bound by Listen is
+	// advertised instead.
+	PublicAddr string
+
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+
+	done chan struct{}  // closed on shutdown to stop reconnecting to peers
+	wg   sync.WaitGroup // waits for reconnecting goroutines
 }
 
 func GenerateSecretKey() kademlia.PrivateKey {
@@ -72,6 +95,7 @@ func NewStreamNode(sk kademlia.PrivateKey, kid *kademlia.ID, tab *kademlia.Table
 		Services:    nil,
 		clientsMu:   sync.Mutex{},
 		clients:     make(map[string]*st.Client),
+		done:        make(chan struct{}),
 	}
 }
 
@@ -168,12 +192,21 @@ func (n *StreamNode) setStreamTransmitServer() {
 	}
 }
 
+func (n *StreamNode) getCodec() Codec {
+	if n.Codec == nil {
+		return DefaultCodec
+	}
+	return n.Codec
+}
+
 func (n *StreamNode) getClient(addr string) *st.Client {
 	n.clientsMu.Lock()
 	defer n.clientsMu.Unlock()
 
 	client, exists := n.clients[addr]
 	if !exists {
+		n.seal()
+
 		client = &st.Client{
 			Addr:      addr,
 			Handler:   n,
@@ -254,15 +287,45 @@ func (n *StreamNode) getServiceNames() []string {
 }
 
 func (n *StreamNode) Push(services []string, headers map[string]string, body io.ReadCloser) (*Stream, error) {
-	providers := n.providers.getProviders(services...)
+	return n.PushContext(context.Background(), services, headers, body)
+}
 
-	// TODO(from kenta): add additional strategies for selecting providers
-	rand.Shuffle(len(providers), func(i, j int) {
-		providers[i], providers[j] = providers[j], providers[i]
-	})
+// PushContext pushes to a random provider of the given services through the middleware of the
+// node. See Provider.PushContext.
+func (n *StreamNode) PushContext(ctx context.Context, services []string, headers map[string]string, body io.ReadCloser) (*Stream, error) {
+	inv := &Invocation{Services: services, Headers: headers, Body: body}
+	if err := n.getInvoker()(ctx, inv); err != nil {
+		return nil, err
+	}
+	return inv.Stream, nil
+}
+
+func (n *StreamNode) pushContext(ctx context.Context, services []string, headers map[string]string, body io.ReadCloser) (*Stream, error) {
+	if body == nil {
+		return nil, errNilBody
+	}
 
-	for _, provider := range providers {
-		stream, err := provider.Push(services, headers, body)
+	for _, provider := range n.shuffledProviders(services...) {
+		stream, err := provider.openStream(ctx, services, headers)
+		if err != nil {
+			if errors.Is(err, ErrProviderNotAvailable) {
+				continue
+			}
+			body.Close()
+			return nil, err
+		}
+		return provider.push(stream, body)
+	}
+
+	body.Close()
+
+	return nil, fmt.Errorf("no nodes were able to process your request for service(s): %s", services)
+}
+
+// OpenStream opens a stream to a random provider of the given services. See Provider.OpenStream.
+func (n *StreamNode) OpenStream(services []string, headers map[string]string) (*Stream, error) {
+	for _, provider := range n.shuffledProviders(services...) {
+		stream, err := provider.OpenStream(services, headers)
 		if err != nil {
 			if errors.Is(err, ErrProviderNotAvailable) {
 				continue
@@ -275,6 +338,18 @@ func (n *StreamNode) Push(services []string, headers map[string]string, body io.
 	return nil, fmt.Errorf("no nodes were able to process your request for service(s): %s", services)
 }
 
+// shuffledProviders returns all providers of the given services in random order.
+func (n *StreamNode) shuffledProviders(services ...string) []*Provider {
+	providers := n.providers.getProviders(services...)
+
+	// TODO(from kenta): add additional strategies for selecting providers
+	rand.Shuffle(len(providers), func(i, j int) {
+		providers[i], providers[j] = providers[j], providers[i]
+	})
+
+	return providers
+}
+
 func (n *StreamNode) ProvidersFor(services ...string) []*Provider {
 	set := make(map[kademlia.PublicKey]*Provider)
 	for _, provider := range n.providers.getProviders(services...) {
@@ -322,7 +397,15 @@ func (n *StreamNode) HandleConnState(conn *st.Conn, state st.ConnState) {
 		return
 	}
 
+	if n.shuttingDown() {
+		return
+	}
+
+	n.wg.Add(1)
+
 	go func() {
+		defer n.wg.Done()
+
 		b := &backoff.Backoff{
 			Factor: 1.25,
 			Jitter: true,
@@ -331,6 +414,10 @@ func (n *StreamNode) HandleConnState(conn *st.Conn, state st.ConnState) {
 		}
 
 		for i := 0; i < 8; i++ { // 8 attempts max
+			if n.shuttingDown() {
+				return
+			}
+
 			err := n.ProbeWithAddr(addr)
 			if err == nil {
 				return
@@ -339,13 +426,27 @@ func (n *StreamNode) HandleConnState(conn *st.Conn, state st.ConnState) {
 			duration := b.Duration()
 
 			log.Printf("Trying to reconnect to %s. Sleeping for %s.", addr, duration)
-			time.Sleep(duration)
+
+			select {
+			case <-time.After(duration):
+			case <-n.done:
+				return
+			}
 		}
 
 		log.Printf("Tried 8 times reconnecting to %s. Giving up.", addr)
 	}()
 }
 
+func (n *StreamNode) shuttingDown() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (n *StreamNode) getResolvedString(addr string) (string, error) {
 	switch n.NetProtocol {
 	case NetProtocolTCP:
@@ -470,52 +571,106 @@ func (n *StreamNode) HandleMessage(ctx *st.Context) error {
 		}
 
 		for _, service := range packet.Services {
-			handler, exists := n.Services[service]
+			handler, exists := n.handler(service)
 			if !exists {
 				continue
 			}
 
-			go func() {
-				ctx := contextPool.acquire(*provider.kadId, packet.Headers, stream.Reader, stream.ID, ctx.Conn())
-				defer contextPool.release(ctx)
-				defer ctx.Body.Close()
+			go n.serve(provider, stream, service, packet.Headers, handler, nil)
 
-				handler(ctx)
+			return nil
+		}
 
-				if !ctx.written {
-					packet := ServiceResponsePacket{
-						StreamId: ctx.streamId,
-						Handled:  true,
-						Headers:  ctx.responseHeaders,
-					}
+		response := ServiceResponsePacket{
+			StreamId: packet.StreamId,
+			Status:   StatusNotFound,
+			Message:  fmt.Sprintf("no handler for service(s): %s", packet.Services),
+		}
 
-					ctx.written = true
+		err = ctx.Conn().SendNoWait(response.AppendTo([]byte{OpCodeServiceResponse}))
+		if err != nil {
+			return err
+		}
 
-					err := ctx.conn.Send(packet.AppendTo([]byte{OpCodeServiceResponse}))
-					if err != nil {
-						provider.CloseStreamWithError(stream, err)
-						return
-					}
+		provider.CloseStreamWithError(stream, response.statusError())
 
-					return
-				}
+		return nil
+	case OpCodeCallRequest:
+		provider := n.providers.FindProvider(ctx.Conn())
+		if provider == nil {
+			return errors.New("conn is not a provider")
+		}
 
-				err := ctx.conn.Send(DataPacket{StreamID: stream.ID}.AppendTo([]byte{OpCodeData}))
-				if err != nil {
-					provider.CloseStreamWithError(stream, err)
-					return
-				}
-			}()
+		packet, err := UnmarshalCallRequestPacket(body)
+		if err != nil {
+			return fmt.Errorf("failed to decode call request packet: %w", err)
+		}
+
+		stream, created := provider.registerStream(packet.StreamID)
+		if !created {
+			return fmt.Errorf("got call request with stream id %d, but node is making service request"+
+				"with the given id already", packet.StreamID)
+		}
+
+		// the request was received in full along with the packet
+
+		provider.finishRecv(stream, nil)
 
+		handler, exists := n.handler(packet.Service)
+		if exists {
+			go n.serve(provider, stream, packet.Service, packet.Headers, handler, packet.Body)
 			return nil
 		}
 
-		response := ServiceResponsePacket{
-			StreamId: packet.StreamId,
-			Handled:  false,
+		response := CallResponsePacket{
+			StreamID: packet.StreamID,
+			Status:   StatusNotFound,
+			Message:  fmt.Sprintf("no handler for service: %s", packet.Service),
 		}
 
-		return ctx.Conn().SendNoWait(response.AppendTo([]byte{OpCodeServiceResponse}))
+		err = ctx.Conn().SendNoWait(response.AppendTo([]byte{OpCodeCallResponse}))
+		if err != nil {
+			return err
+		}
+
+		provider.CloseStreamWithError(stream, response.statusError())
+
+		return nil
+	case OpCodeCallResponse:
+		provider := n.providers.FindProvider(ctx.Conn())
+		if provider == nil {
+			return errors.New("conn is not a provider")
+		}
+
+		packet, err := UnmarshalCallResponsePacket(body)
+		if err != nil {
+			return fmt.Errorf("failed to decode call response packet: %w", err)
+		}
+
+		// the call may have been canceled since
+
+		stream, exists := provider.GetStream(packet.StreamID)
+		if !exists {
+			return nil
+		}
+
+		stream.Header = &ServiceResponsePacket{
+			StreamId: packet.StreamID,
+			Status:   packet.Status,
+			Message:  packet.Message,
+			Details:  packet.Details,
+			Headers:  packet.Headers,
+		}
+		stream.callBody = packet.Body
+
+		if status := packet.statusError(); status != nil {
+			provider.CloseStreamWithError(stream, status)
+			return nil
+		}
+
+		provider.finishRecv(stream, nil)
+
+		return nil
 	case OpCodeServiceResponse:
 		provider := n.providers.FindProvider(ctx.Conn())
 		if provider == nil {
@@ -527,15 +682,22 @@ func (n *StreamNode) HandleMessage(ctx *st.Context) error {
 			return fmt.Errorf("failed to decode services response packet: %w", err)
 		}
 
+		// the stream may have been canceled since
+
 		stream, exists := provider.GetStream(packet.StreamId)
 		if !exists {
-			return fmt.Errorf("stream with id %d got a service response although no service request was sent",
-				packet.StreamId)
+			return nil
 		}
 
 		stream.Header = &packet
 		stream.once.Do(stream.wg.Done)
 
+		// there will be no response, and the request must not be sent any further
+
+		if status := packet.statusError(); status != nil {
+			provider.CloseStreamWithError(stream, status)
+		}
+
 		return nil
 	case OpCodeData:
 		provider := n.providers.FindProvider(ctx.Conn())
@@ -548,11 +710,13 @@ func (n *StreamNode) HandleMessage(ctx *st.Context) error {
 			return fmt.Errorf("failed to decode stream payload packet: %w", err)
 		}
 
-		// the stream must always exist
+		// the stream may have been canceled or reset since, in which case the chunk is
+		// discarded
 
 		stream, exists := provider.GetStream(packet.StreamID)
 		if !exists {
-			return fmt.Errorf("stream with id %d does not exist", packet.StreamID)
+			provider.release(nil, len(packet.Data))
+			return nil
 		}
 
 		// there should never be any empty payload packets
@@ -571,19 +735,77 @@ func (n *StreamNode) HandleMessage(ctx *st.Context) error {
 		//	return err
 		//}
 
-		// if the chunk is zero-length, the stream has been closed
+		// if the chunk is zero-length, the stream has been closed, and the chunk may carry
+		// trailers
 
 		if len(packet.Data) == 0 {
-			provider.CloseStreamWithError(stream, io.EOF)
+			provider.finishRecv(stream, packet.Trailers)
 		} else {
-			_, err = stream.Writer.Write(packet.Data)
+			// the chunk is buffered rather than waited on to be read, such that a slow reader
+			// does not hold up other streams of the connection
+
+			err = stream.Reader.write(packet.Data)
 			if err != nil {
-				err = fmt.Errorf("failed to write payload: %w", err)
-				provider.CloseStreamWithError(stream, err)
-				return err
+				err = fmt.Errorf("stream with id %d failed to buffer payload: %w", packet.StreamID, err)
+				provider.release(nil, len(packet.Data))
+				provider.resetStream(stream, ResetFlowControlError, err.Error(), err)
 			}
 		}
 
+		return nil
+	case OpCodeWindowUpdate:
+		provider := n.providers.FindProvider(ctx.Conn())
+		if provider == nil {
+			return errors.New("conn is not a provider")
+		}
+
+		packet, err := UnmarshalWindowUpdatePacket(body)
+		if err != nil {
+			return fmt.Errorf("failed to decode window update packet: %w", err)
+		}
+
+		if packet.StreamID == connStreamID {
+			if !provider.window.add(int(packet.Increment)) {
+				return fmt.Errorf("connection window update of %d bytes: %w", packet.Increment, ErrFlowControl)
+			}
+			return nil
+		}
+
+		// the stream may have already been closed
+
+		stream, exists := provider.GetStream(packet.StreamID)
+		if !exists {
+			return nil
+		}
+
+		if !stream.window.add(int(packet.Increment)) {
+			err = fmt.Errorf("stream with id %d got window update of %d bytes: %w",
+				packet.StreamID, packet.Increment, ErrFlowControl)
+			provider.CloseStreamWithError(stream, err)
+			return err
+		}
+
+		return nil
+	case OpCodeReset:
+		provider := n.providers.FindProvider(ctx.Conn())
+		if provider == nil {
+			return errors.New("conn is not a provider")
+		}
+
+		packet, err := UnmarshalResetPacket(body)
+		if err != nil {
+			return fmt.Errorf("failed to decode reset packet: %w", err)
+		}
+
+		// the stream may have already been closed
+
+		stream, exists := provider.GetStream(packet.StreamID)
+		if !exists {
+			return nil
+		}
+
+		provider.CloseStreamWithError(stream, &ResetError{Code: packet.Code, Message: packet.Message, Remote: true})
+
 		return nil
 	case OpCodeFindNodeRequest:
 		packet, _, err := kademlia.UnmarshalFindNodeRequest(body)
@@ -601,6 +823,86 @@ func (n *StreamNode) HandleMessage(ctx *st.Context) error {
 	return fmt.Errorf("unknown opcode %d", opcode)
 }
 
+// serve handles a stream to service with handler, which is wrapped by the middleware of the
+// node. If the stream is a call, its request is given by body, and its response is sent in a
+// single packet if it fits.
+func (n *StreamNode) serve(provider *Provider, stream *Stream, service string, headers map[string]string, handler Handler, body []byte) {
+	sctx, cancel := provider.streamContext(stream, headers)
+	defer cancel()
+
+	ctx := contextPool.acquire(*provider.kadId, service, headers, provider, stream)
+	defer contextPool.release(ctx)
+
+	ctx.ctx = sctx
+
+	if body != nil {
+		ctx.callReader.Reset(body)
+		ctx.Body = &ctx.callReader
+		ctx.unary = true
+	}
+
+	defer ctx.Body.Close()
+
+	err := handler(ctx)
+
+	if ctx.Err() != nil { // the stream was canceled or reset
+		return
+	}
+
+	status := ErrorStatus(err)
+
+	if ctx.unary {
+		sent, err := ctx.writeCallResponse(status)
+		if err != nil {
+			provider.CloseStreamWithError(stream, err)
+			return
+		}
+		if sent {
+			provider.finishSend(stream)
+			return
+		}
+
+		// the response along with its headers does not fit in a single packet, and is
+		// streamed instead
+
+		if status == nil {
+			if err := ctx.streamCall(); err != nil {
+				provider.CloseStreamWithError(stream, err)
+				return
+			}
+		}
+		ctx.unary = false
+	}
+
+	// once a response header was written, a failure can only be told by resetting the stream
+
+	if status != nil && ctx.written {
+		ctx.Reset(ResetInternalError, status.Error())
+		return
+	}
+
+	if !ctx.written {
+		err := ctx.writeResponse(status)
+		if err != nil {
+			provider.CloseStreamWithError(stream, err)
+			return
+		}
+	}
+
+	// a stream that was not handled successfully ends with its response header on both sides
+
+	if status != nil {
+		provider.CloseStreamWithError(stream, status)
+		return
+	}
+
+	err = stream.Writer.closeWithTrailers(ctx.trailers)
+	if err != nil {
+		provider.CloseStreamWithError(stream, err)
+		return
+	}
+}
+
 func (n *StreamNode) Start() error {
 	start := false
 	n.start.Do(func() { start = true })
@@ -608,11 +910,152 @@ func (n *StreamNode) Start() error {
 		return errors.New("listener already started")
 	}
 
+	if n.done == nil {
+		n.done = make(chan struct{})
+	}
+
+	n.seal()
 	n.setStreamTransmitServer()
 
 	return nil
 }
 
+// Listen starts the node if it has not been started yet, and binds a listener to each of the
+// given addresses. The KadId of the node is filled in with the public key of its SecretKey,
+// and with the host and port of PublicAddr, or of the first listener if PublicAddr is empty.
+// If KadId already has a host and port, they must match the advertised address.
+func (n *StreamNode) Listen(addrs ...string) error {
+	if len(addrs) == 0 {
+		return errors.New("no addresses to listen on")
+	}
+	if n.NetProtocol != NetProtocolTCP {
+		return errors.New("stream nodes may only listen on tcp")
+	}
+
+	n.start.Do(func() {
+		if n.done == nil {
+			n.done = make(chan struct{})
+		}
+		n.seal()
+		n.setStreamTransmitServer()
+	})
+
+	if n.shuttingDown() {
+		return errors.New("node is shut down")
+	}
+
+	lns := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return fmt.Errorf("failed to listen on '%s': %w", addr, err)
+		}
+		lns = append(lns, ln)
+	}
+
+	n.listenersMu.Lock()
+	defer n.listenersMu.Unlock()
+
+	advertised := n.PublicAddr
+	if advertised == "" && len(n.listeners) == 0 {
+		advertised = lns[0].Addr().String()
+	}
+
+	if advertised != "" {
+		err := n.advertise(advertised)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+	}
+
+	n.listeners = append(n.listeners, lns...)
+
+	return nil
+}
+
+// advertise fills in or validates the host and port of the KadId of the node against addr.
+func (n *StreamNode) advertise(addr string) error {
+	resolved, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve advertised address '%s': %w", addr, err)
+	}
+	if resolved.IP == nil || resolved.IP.IsUnspecified() {
+		return fmt.Errorf("cannot advertise unspecified address '%s', set a public address", addr)
+	}
+
+	host, port := resolved.IP, uint16(resolved.Port)
+	if ip := host.To4(); ip != nil {
+		host = ip
+	}
+
+	if n.KadId == nil {
+		if n.SecretKey.Zero() {
+			return nil
+		}
+		n.KadId = &kademlia.ID{Pub: n.SecretKey.Public()}
+	}
+
+	if n.KadId.Host == nil && n.KadId.Port == 0 {
+		n.KadId.Host, n.KadId.Port = host, port
+		return nil
+	}
+
+	if !n.KadId.Host.Equal(host) || n.KadId.Port != port {
+		return fmt.Errorf("id advertises '%s', but node is reachable at '%s'",
+			HostAddr(n.KadId.Host, n.KadId.Port), HostAddr(host, port))
+	}
+
+	return nil
+}
+
+// Addrs returns the addresses of all listeners bound by Listen.
+func (n *StreamNode) Addrs() []net.Addr {
+	n.listenersMu.Lock()
+	defer n.listenersMu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(n.listeners))
+	for _, ln := range n.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Serve serves all listeners bound by Listen, and blocks until all of them stopped serving. It
+// returns nil once the node is shut down, and the first error of any listener otherwise.
+func (n *StreamNode) Serve() error {
+	n.listenersMu.Lock()
+	lns := append([]net.Listener(nil), n.listeners...)
+	n.listenersMu.Unlock()
+
+	if len(lns) == 0 {
+		return errors.New("node is not listening on any address")
+	}
+
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		ln := ln
+		go func() {
+			errs <- n.Srv.Serve(ln)
+		}()
+	}
+
+	var err error
+	for range lns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Shutdown stops reconnecting to peers, closes all connections made to and accepted from peers,
+// and closes all listeners bound by Listen.
 func (n *StreamNode) Shutdown() {
 	once := false
 	n.start.Do(func() { once = true })
@@ -626,5 +1069,22 @@ func (n *StreamNode) Shutdown() {
 		return
 	}
 
+	close(n.done)
+
 	n.Srv.Shutdown()
+
+	n.clientsMu.Lock()
+	for _, client := range n.clients {
+		client.Shutdown()
+	}
+	n.clientsMu.Unlock()
+
+	n.listenersMu.Lock()
+	for _, ln := range n.listeners {
+		_ = ln.Close()
+	}
+	n.listeners = nil
+	n.listenersMu.Unlock()
+
+	n.wg.Wait()
 }
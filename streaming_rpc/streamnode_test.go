@@ -0,0 +1,593 @@
+package streaming_rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lithdew/kademlia"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// newTestNode starts a node serving services on a random local port.
+func newTestNode(t testing.TB, services map[string]Handler) *StreamNode {
+	sk := GenerateSecretKey()
+
+	node := NewStreamNode(sk, nil, kademlia.NewTable(sk.Public()))
+	node.Services = services
+
+	require.NoError(t, node.Listen("127.0.0.1:0"))
+
+	go func() {
+		require.NoError(t, node.Serve())
+	}()
+
+	return node
+}
+
+// connectTestNodes starts a node serving services, and a node that is connected to it.
+func connectTestNodes(t testing.TB, services map[string]Handler) (*StreamNode, *StreamNode) {
+	server := newTestNode(t, services)
+	client := newTestNode(t, nil)
+
+	require.NoError(t, client.ProbeWithAddr(server.Addrs()[0].String()))
+
+	return server, client
+}
+
+func TestStreamNodeListen(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	echo := func(ctx *Context) error {
+		buf, err := ioutil.ReadAll(ctx.Body)
+		if err != nil {
+			return err
+		}
+		_, err = ctx.Write(buf)
+		return err
+	}
+
+	server, client := connectTestNodes(t, map[string]Handler{"echo": echo})
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	addr := server.Addrs()[0].(*net.TCPAddr)
+	require.NotNil(t, server.KadId)
+	require.Equal(t, server.SecretKey.Public(), server.KadId.Pub)
+	require.True(t, server.KadId.Host.Equal(addr.IP))
+	require.EqualValues(t, addr.Port, server.KadId.Port)
+
+	require.Len(t, client.ProvidersFor("echo"), 1)
+
+	stream, err := client.Push([]string{"echo"}, nil, ioutil.NopCloser(strings.NewReader("hello")))
+	require.NoError(t, err)
+
+	res, err := ioutil.ReadAll(stream.Reader)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+}
+
+func TestStreamNodeListenValidatesID(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	sk := GenerateSecretKey()
+
+	node := NewStreamNode(sk, &kademlia.ID{Pub: sk.Public(), Host: net.ParseIP("127.0.0.1"), Port: 1}, nil)
+	defer node.Shutdown()
+
+	require.Error(t, node.Listen("127.0.0.1:0"))
+	require.Empty(t, node.Addrs())
+
+	node.PublicAddr = "127.0.0.1:1"
+	require.NoError(t, node.Listen("127.0.0.1:0"))
+	require.Len(t, node.Addrs(), 1)
+
+	node.PublicAddr = "0.0.0.0:1"
+	require.Error(t, node.Listen("127.0.0.1:0"))
+}
+
+func TestStreamNodeSlowReader(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	unblock := make(chan struct{})
+
+	services := map[string]Handler{
+		"slow": func(ctx *Context) error {
+			<-unblock
+
+			buf, err := ioutil.ReadAll(ctx.Body)
+			if err != nil {
+				return err
+			}
+			_, err = ctx.Write([]byte(strconv.Itoa(len(buf))))
+			return err
+		},
+		"echo": func(ctx *Context) error {
+			buf, err := ioutil.ReadAll(ctx.Body)
+			if err != nil {
+				return err
+			}
+			_, err = ctx.Write(buf)
+			return err
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	// the body of the slow stream does not fit in its window, and blocks pushing it until the
+	// handler reads it
+
+	body := bytes.Repeat([]byte("a"), 4*StreamWindowSize)
+
+	slow := make(chan []byte)
+	go func() {
+		stream, err := client.Push([]string{"slow"}, nil, ioutil.NopCloser(bytes.NewReader(body)))
+		require.NoError(t, err)
+
+		res, err := ioutil.ReadAll(stream.Reader)
+		require.NoError(t, err)
+
+		slow <- res
+	}()
+
+	// other streams are not held up by the slow stream
+
+	payload := bytes.Repeat([]byte("b"), 2*StreamWindowSize)
+
+	for i := 0; i < 4; i++ {
+		stream, err := client.Push([]string{"echo"}, nil, ioutil.NopCloser(bytes.NewReader(payload)))
+		require.NoError(t, err)
+
+		res, err := ioutil.ReadAll(stream.Reader)
+		require.NoError(t, err)
+		require.Equal(t, payload, res)
+	}
+
+	close(unblock)
+
+	require.EqualValues(t, strconv.Itoa(len(body)), <-slow)
+}
+
+func TestStreamNodePushStreamingEcho(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// the handler responds while it is still reading the body, such that pushing a body larger
+	// than the windows of both directions requires the response to be read along the way
+
+	services := map[string]Handler{
+		"echo": func(ctx *Context) error {
+			_, err := io.Copy(ctx, ctx.Body)
+			return err
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	body := bytes.Repeat([]byte("a"), 8*StreamWindowSize)
+
+	stream, err := client.Push([]string{"echo"}, nil, ioutil.NopCloser(bytes.NewReader(body)))
+	require.NoError(t, err)
+
+	res, err := ioutil.ReadAll(stream.Reader)
+	require.NoError(t, err)
+	require.Equal(t, body, res)
+}
+
+func TestStreamNodePushBody(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	services := map[string]Handler{
+		"reject": func(ctx *Context) error {
+			return NewStatusError(StatusInternal, "rejected")
+		},
+		"drain": func(ctx *Context) error {
+			_, err := io.Copy(ioutil.Discard, ctx.Body)
+			return err
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	_, err := client.Push([]string{"drain"}, nil, nil)
+	require.Error(t, err)
+
+	// the body is closed and no longer read once the push fails, even though it never ended
+
+	body, w := io.Pipe()
+
+	_, err = client.Push([]string{"reject"}, nil, body)
+	require.Equal(t, StatusInternal, ErrorStatus(err).Code)
+
+	_, err = w.Write([]byte("unread"))
+	require.Equal(t, io.ErrClosedPipe, err)
+
+	// failing to read the body fails the push with the error the body failed with
+
+	fail := errors.New("body failed")
+
+	body, w = io.Pipe()
+	w.CloseWithError(fail)
+
+	_, err = client.Push([]string{"drain"}, nil, body)
+	require.True(t, errors.Is(err, fail), err)
+}
+
+func TestStreamNodeOpenStream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	services := map[string]Handler{
+		"chat": func(ctx *Context) error {
+			ctx.WriteHeader("chat", "yes")
+
+			scanner := bufio.NewScanner(ctx.Body)
+			for scanner.Scan() {
+				_, err := ctx.Write([]byte("re: " + scanner.Text() + "\n"))
+				if err != nil {
+					return err
+				}
+			}
+			return scanner.Err()
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	stream, err := client.OpenStream([]string{"chat"}, nil)
+	require.NoError(t, err)
+
+	// every message is replied to before the next one is sent
+
+	reader := bufio.NewReader(stream.Reader)
+
+	for _, msg := range []string{"hello", "world"} {
+		_, err := stream.Writer.Write([]byte(msg + "\n"))
+		require.NoError(t, err)
+
+		if msg == "hello" {
+			header, err := stream.ReadHeader()
+			require.NoError(t, err)
+			require.Equal(t, "yes", header.Headers["chat"])
+		}
+
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "re: "+msg+"\n", line)
+	}
+
+	// the handler returns once the request is closed, which closes the response
+
+	require.NoError(t, stream.CloseWrite())
+
+	_, err = stream.Writer.Write([]byte("closed"))
+	require.Error(t, err)
+
+	_, err = reader.ReadByte()
+	require.Equal(t, io.EOF, err)
+
+	// streams opened for services the provider does not handle fail
+
+	stream, err = client.ProvidersFor("chat")[0].OpenStream([]string{"missing"}, nil)
+	require.NoError(t, err)
+
+	_, err = stream.ReadHeader()
+	require.Error(t, err)
+
+	_, err = stream.Writer.Write([]byte("hello"))
+	require.Error(t, err)
+}
+
+func TestStreamNodeReset(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	handlerErr := make(chan error, 1)
+
+	services := map[string]Handler{
+		"infinite": func(ctx *Context) error {
+			for {
+				if _, err := ctx.Write(bytes.Repeat([]byte("a"), ChunkSize)); err != nil {
+					break
+				}
+			}
+			<-ctx.Done()
+			handlerErr <- ctx.Err()
+			return ctx.Err()
+		},
+		"fail": func(ctx *Context) error {
+			_, err := ctx.Write([]byte("partial"))
+			if err != nil {
+				return err
+			}
+			ctx.Reset(ResetInternalError, "boom")
+			return nil
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	// canceling a stream stops its handler
+
+	stream, err := client.OpenStream([]string{"infinite"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseWrite())
+
+	_, err = io.ReadFull(stream.Reader, make([]byte, 4*ChunkSize))
+	require.NoError(t, err)
+
+	stream.Cancel()
+
+	_, err = ioutil.ReadAll(stream.Reader)
+	require.True(t, errors.Is(err, ErrStreamCanceled), err)
+
+	var resetErr *ResetError
+
+	require.True(t, errors.As(<-handlerErr, &resetErr))
+	require.Equal(t, ResetCanceled, resetErr.Code)
+	require.True(t, resetErr.Remote)
+
+	// handlers may reset streams midway
+
+	stream, err = client.Push([]string{"fail"}, nil, ioutil.NopCloser(strings.NewReader("")))
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(stream.Reader)
+	require.True(t, errors.As(err, &resetErr), err)
+	require.Equal(t, ResetInternalError, resetErr.Code)
+	require.Equal(t, "boom", resetErr.Message)
+	require.True(t, resetErr.Remote)
+}
+
+func TestStreamNodePushContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	deadlines := make(chan bool, 1)
+	handlerErr := make(chan error, 1)
+
+	services := map[string]Handler{
+		"wait": func(ctx *Context) error {
+			_, hasDeadline := ctx.Context().Deadline()
+			deadlines <- hasDeadline
+
+			_, err := ctx.Write([]byte("waiting"))
+			if err != nil {
+				return err
+			}
+
+			<-ctx.Context().Done()
+			handlerErr <- ctx.Context().Err()
+			return ctx.Context().Err()
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	// the deadline of the caller is propagated to the handler, and cancels both sides once it
+	// passes
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	stream, err := client.PushContext(ctx, []string{"wait"}, nil, ioutil.NopCloser(strings.NewReader("")))
+	require.NoError(t, err)
+	require.True(t, <-deadlines)
+
+	_, err = ioutil.ReadAll(stream.Reader)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.Error(t, <-handlerErr)
+
+	// canceling the context of the caller cancels the handler
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	stream, err = client.PushContext(ctx, []string{"wait"}, nil, ioutil.NopCloser(strings.NewReader("")))
+	require.NoError(t, err)
+	require.False(t, <-deadlines)
+
+	cancel()
+
+	_, err = ioutil.ReadAll(stream.Reader)
+	require.True(t, errors.Is(err, context.Canceled), err)
+	require.True(t, errors.Is(<-handlerErr, context.Canceled))
+}
+
+func TestStreamNodeStatus(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	services := map[string]Handler{
+		"invalid": func(ctx *Context) error {
+			ctx.WriteHeader("checked", "yes")
+			return &StatusError{Code: StatusInvalidArgument, Message: "bad request", Details: []byte("details")}
+		},
+		"internal": func(ctx *Context) error {
+			return errors.New("boom")
+		},
+		"midway": func(ctx *Context) error {
+			_, err := ctx.Write([]byte("partial"))
+			if err != nil {
+				return err
+			}
+			return NewStatusError(StatusUnavailable, "gone")
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	push := func(services ...string) error {
+		_, err := client.ProvidersFor("internal")[0].Push(services, nil, ioutil.NopCloser(strings.NewReader("")))
+		return err
+	}
+
+	var status *StatusError
+
+	require.True(t, errors.As(push("invalid"), &status))
+	require.Equal(t, StatusInvalidArgument, status.Code)
+	require.Equal(t, "bad request", status.Message)
+	require.EqualValues(t, "details", status.Details)
+
+	require.True(t, errors.As(push("internal"), &status))
+	require.Equal(t, StatusInternal, status.Code)
+	require.Equal(t, "boom", status.Message)
+
+	require.True(t, errors.As(push("missing"), &status))
+	require.Equal(t, StatusNotFound, status.Code)
+
+	// failures after the response header was written reset the stream
+
+	stream, err := client.Push([]string{"midway"}, nil, ioutil.NopCloser(strings.NewReader("")))
+	require.NoError(t, err)
+
+	var resetErr *ResetError
+
+	_, err = ioutil.ReadAll(stream.Reader)
+	require.True(t, errors.As(err, &resetErr), err)
+	require.Contains(t, resetErr.Message, "gone")
+}
+
+func TestStreamNodeTrailers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	services := map[string]Handler{
+		"count": func(ctx *Context) error {
+			n, err := io.Copy(ctx, ctx.Body)
+			if err != nil {
+				return err
+			}
+			ctx.SetTrailer("count", strconv.FormatInt(n, 10))
+			return nil
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	body := bytes.Repeat([]byte("a"), 3*ChunkSize+1)
+
+	stream, err := client.Push([]string{"count"}, nil, ioutil.NopCloser(bytes.NewReader(body)))
+	require.NoError(t, err)
+
+	res, err := ioutil.ReadAll(stream.Reader)
+	require.NoError(t, err)
+	require.Equal(t, body, res)
+	require.Equal(t, map[string]string{"count": strconv.Itoa(len(body))}, stream.Trailer)
+}
+
+func TestStreamNodeCall(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	services := map[string]Handler{
+		"echo": func(ctx *Context) error {
+			ctx.WriteHeader("header", "yes")
+			n, err := io.Copy(ctx, ctx.Body)
+			if err != nil {
+				return err
+			}
+			ctx.SetTrailer("count", strconv.FormatInt(n, 10))
+			return nil
+		},
+		"repeat": func(ctx *Context) error {
+			buf, err := ioutil.ReadAll(ctx.Body)
+			if err != nil {
+				return err
+			}
+			_, err = ctx.Write(bytes.Repeat(buf, 4*MaxCallPacketSize))
+			return err
+		},
+		"invalid": func(ctx *Context) error {
+			return NewStatusError(StatusInvalidArgument, "bad request")
+		},
+	}
+
+	server, client := connectTestNodes(t, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	// small and large requests are echoed back, the latter being streamed
+
+	for _, req := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("a"), 4*MaxCallPacketSize)} {
+		res, headers, err := client.Call(context.Background(), "echo", nil, req)
+		require.NoError(t, err)
+		require.Equal(t, req, res)
+		require.Equal(t, map[string]string{"header": "yes", "count": strconv.Itoa(len(req))}, headers)
+	}
+
+	// large responses to small requests are streamed
+
+	res, _, err := client.Call(context.Background(), "repeat", nil, []byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("b"), 4*MaxCallPacketSize), res)
+
+	var status *StatusError
+
+	_, _, err = client.Call(context.Background(), "invalid", nil, nil)
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusInvalidArgument, status.Code)
+
+	_, _, err = client.ProvidersFor("echo")[0].Call(context.Background(), "missing", nil, nil)
+	require.True(t, errors.As(err, &status), err)
+	require.Equal(t, StatusNotFound, status.Code)
+}
+
+func benchmarkStreamNode(b *testing.B, call func(client *StreamNode, req []byte) error) {
+	services := map[string]Handler{
+		"echo": func(ctx *Context) error {
+			_, err := io.Copy(ctx, ctx.Body)
+			return err
+		},
+	}
+
+	server, client := connectTestNodes(b, services)
+	defer server.Shutdown()
+	defer client.Shutdown()
+
+	req := bytes.Repeat([]byte("a"), 128)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := call(client, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPush(b *testing.B) {
+	benchmarkStreamNode(b, func(client *StreamNode, req []byte) error {
+		stream, err := client.Push([]string{"echo"}, nil, ioutil.NopCloser(bytes.NewReader(req)))
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(stream.Reader)
+		return err
+	})
+}
+
+func BenchmarkCall(b *testing.B) {
+	benchmarkStreamNode(b, func(client *StreamNode, req []byte) error {
+		_, _, err := client.Call(context.Background(), "echo", nil, req)
+		return err
+	})
+}
@@ -0,0 +1,84 @@
+package streaming_rpc
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// The number of bytes that may be sent over a stream, and over all streams of a connection,
+// before the receiver grants more with a WindowUpdatePacket. The receiver grants bytes back as
+// they are read, such that a slow reader only slows down its own stream, and such that no more
+// than StreamWindowSize bytes are ever buffered for a stream.
+const (
+	StreamWindowSize = 1 << 16
+	ConnWindowSize   = 1 << 20
+)
+
+// connStreamID is the stream id of window updates for the connection rather than for a stream.
+const connStreamID = math.MaxUint32
+
+// maxWindowSize is the largest number of bytes a window may grow to.
+const maxWindowSize = math.MaxInt32
+
+var ErrFlowControl = errors.New("flow control window exceeded")
+
+// window counts the number of bytes that may still be sent over a stream or connection.
+type window struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	size int
+	err  error
+}
+
+func newWindow(size int) *window {
+	w := &window{size: size}
+	w.cond.L = &w.mu
+	return w
+}
+
+// take waits for the window to open up, and takes up to max bytes out of it.
+func (w *window) take(max int) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.size <= 0 && w.err == nil {
+		w.cond.Wait()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := max
+	if n > w.size {
+		n = w.size
+	}
+	w.size -= n
+
+	return n, nil
+}
+
+// add puts n bytes into the window. It reports false if that would overflow the window.
+func (w *window) add(n int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > maxWindowSize-n {
+		return false
+	}
+	w.size += n
+	w.cond.Broadcast()
+
+	return true
+}
+
+// close makes all current and future calls to take fail with err.
+func (w *window) close(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+	w.cond.Broadcast()
+}
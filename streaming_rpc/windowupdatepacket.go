@@ -0,0 +1,28 @@
+package streaming_rpc
+
+import (
+	"io"
+
+	"github.com/lithdew/bytesutil"
+)
+
+type WindowUpdatePacket struct {
+	StreamID  uint32 // stream id, or connStreamID to update the window of the connection
+	Increment uint32 // number of additional bytes the peer may send
+}
+
+func (p WindowUpdatePacket) AppendTo(dst []byte) []byte {
+	dst = bytesutil.AppendUint32BE(dst, p.StreamID)
+	dst = bytesutil.AppendUint32BE(dst, p.Increment)
+	return dst
+}
+
+func UnmarshalWindowUpdatePacket(buf []byte) (WindowUpdatePacket, error) {
+	var packet WindowUpdatePacket
+	if len(buf) < 4+4 {
+		return packet, io.ErrUnexpectedEOF
+	}
+	packet.StreamID, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+	packet.Increment, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+	return packet, nil
+}
@@ -0,0 +1,178 @@
+package streaming_transmit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var DefaultAdmissionSweepInterval = 1 * time.Minute
+
+// ParseCIDRs parses a list of CIDR notation IP address prefixes, e.g. for Server.AllowCIDRs
+// and Server.DenyCIDRs.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// tokenBucket is a token bucket that refills at rate tokens per second, up to burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// allow takes n tokens out of the bucket if it holds at least n tokens.
+func (b *tokenBucket) allow(n float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// full returns true if the bucket has completely refilled.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// peerAdmission keeps track of the connections a single remote IP has open, and how quickly
+// it has been handshaking.
+type peerAdmission struct {
+	conns      int
+	handshakes *tokenBucket
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit decides whether or not a connection from addr may proceed to its handshake. If it
+// may, the returned release func must be called once the connection is closed.
+func (s *Server) admit(addr net.Addr) (func(), bool) {
+	if s.AcceptFilter != nil && !s.AcceptFilter.Accept(addr) {
+		return nil, false
+	}
+
+	ip := remoteIP(addr)
+	if ip == nil {
+		return func() {}, true
+	}
+
+	if containsIP(s.DenyCIDRs, ip) {
+		return nil, false
+	}
+	if len(s.AllowCIDRs) > 0 && !containsIP(s.AllowCIDRs, ip) {
+		return nil, false
+	}
+
+	if s.MaxConnsPerIP <= 0 && s.HandshakeRate <= 0 {
+		return func() {}, true
+	}
+
+	key := ip.String()
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweepPeers(now)
+
+	peer, exists := s.peers[key]
+	if !exists {
+		peer = &peerAdmission{}
+		if s.HandshakeRate > 0 {
+			peer.handshakes = newTokenBucket(s.HandshakeRate, s.HandshakeBurst, now)
+		}
+		s.peers[key] = peer
+	}
+
+	if s.MaxConnsPerIP > 0 && peer.conns >= s.MaxConnsPerIP {
+		return nil, false
+	}
+	if peer.handshakes != nil && !peer.handshakes.allow(1, now) {
+		return nil, false
+	}
+
+	peer.conns++
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		peer.conns--
+	}, true
+}
+
+// sweepPeers forgets about remote IPs that no longer have any connections open, and whose
+// handshake rate limit has completely refilled. It must be called with s.mu held.
+func (s *Server) sweepPeers(now time.Time) {
+	if now.Sub(s.lastSweep) < DefaultAdmissionSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, peer := range s.peers {
+		if peer.conns > 0 {
+			continue
+		}
+		if peer.handshakes != nil && !peer.handshakes.full(now) {
+			continue
+		}
+		delete(s.peers, key)
+	}
+}
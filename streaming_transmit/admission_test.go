@@ -0,0 +1,111 @@
+package streaming_transmit
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func dialAndHandshake(t *testing.T, addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(1*time.Second)))
+
+	var session Session
+	err = session.DoClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestServerAcceptFilter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var filtered uint32
+
+	server := &Server{
+		AcceptFilter: AcceptFilterFunc(func(addr net.Addr) bool {
+			atomic.AddUint32(&filtered, 1)
+			return atomic.LoadUint32(&filtered) > 1
+		}),
+	}
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	_, err := dialAndHandshake(t, addr)
+	require.Error(t, err)
+
+	conn, err := dialAndHandshake(t, addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	require.EqualValues(t, 2, atomic.LoadUint32(&filtered))
+}
+
+func TestServerCIDRs(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	deny, err := ParseCIDRs("127.0.0.0/8")
+	require.NoError(t, err)
+
+	addr, stop := serveTest(t, &Server{DenyCIDRs: deny})
+	defer stop()
+
+	_, err = dialAndHandshake(t, addr)
+	require.Error(t, err)
+
+	allow, err := ParseCIDRs("10.0.0.0/8", "192.168.0.0/16")
+	require.NoError(t, err)
+
+	addr, stop = serveTest(t, &Server{AllowCIDRs: allow})
+	defer stop()
+
+	_, err = dialAndHandshake(t, addr)
+	require.Error(t, err)
+}
+
+func TestServerMaxConnsPerIP(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	addr, stop := serveTest(t, &Server{MaxConnsPerIP: 1})
+	defer stop()
+
+	first, err := dialAndHandshake(t, addr)
+	require.NoError(t, err)
+
+	_, err = dialAndHandshake(t, addr)
+	require.Error(t, err)
+
+	require.NoError(t, first.Close())
+
+	require.Eventually(t, func() bool {
+		conn, err := dialAndHandshake(t, addr)
+		if err != nil {
+			return false
+		}
+		return conn.Close() == nil
+	}, 1*time.Second, 10*time.Millisecond)
+}
+
+func TestServerHandshakeRate(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	addr, stop := serveTest(t, &Server{HandshakeRate: 0.001, HandshakeBurst: 2})
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialAndHandshake(t, addr)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	_, err := dialAndHandshake(t, addr)
+	require.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package streaming_transmit
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/oasisprotocol/ed25519"
+)
+
+const maxCertificateFrameSize = 4096
+
+// maxCertificateSize is the largest a certificate may be once encoded, such that it fits in a
+// frame along with the signature proving ownership of it once sealed by the AES-GCM suite of
+// the session, whose overhead is 16 bytes.
+const maxCertificateSize = maxCertificateFrameSize - ed25519.SignatureSize - 16
+
+var (
+	certClientLabel = []byte("carlo cert client")
+	certServerLabel = []byte("carlo cert server")
+)
+
+var _ BufferedConn = (*CertSessionConn)(nil)
+
+// CertSessionConn is a SessionConn whose peer proved ownership of a certificate minted by
+// the cluster certificate authority.
+type CertSessionConn struct {
+	*SessionConn
+	peer *Certificate
+}
+
+// PeerCertificate returns the verified certificate of the peer.
+func (c *CertSessionConn) PeerCertificate() *Certificate { return c.peer }
+
+// CertClientHandshaker returns a Handshaker that establishes a session, presents cert to the
+// server, and verifies that the server presents a certificate signed by ca. key must be the
+// private key to cert.
+func CertClientHandshaker(cert *Certificate, key ed25519.PrivateKey, ca ed25519.PublicKey) HandshakerFunc {
+	return func(conn net.Conn) (BufferedConn, error) {
+		var session Session
+		err := session.DoClient(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		clientPub, serverPub := session.ourPub, session.theirPub
+
+		sc := session.NewConn(conn)
+
+		err = writeCertificate(sc, cert, key, certClientLabel, clientPub, serverPub)
+		if err != nil {
+			return nil, err
+		}
+
+		peer, err := readCertificate(sc, ca, certServerLabel, clientPub, serverPub)
+		if err != nil {
+			return nil, err
+		}
+
+		return &CertSessionConn{SessionConn: sc, peer: peer}, nil
+	}
+}
+
+// CertServerHandshaker returns a Handshaker that establishes a session, verifies that the
+// client presents a certificate signed by ca, and presents cert to the client. key must be
+// the private key to cert.
+func CertServerHandshaker(cert *Certificate, key ed25519.PrivateKey, ca ed25519.PublicKey) HandshakerFunc {
+	return func(conn net.Conn) (BufferedConn, error) {
+		var session Session
+		err := session.DoServer(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		clientPub, serverPub := session.theirPub, session.ourPub
+
+		sc := session.NewConn(conn)
+
+		peer, err := readCertificate(sc, ca, certClientLabel, clientPub, serverPub)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeCertificate(sc, cert, key, certServerLabel, clientPub, serverPub)
+		if err != nil {
+			return nil, err
+		}
+
+		return &CertSessionConn{SessionConn: sc, peer: peer}, nil
+	}
+}
+
+// appendCertificateTranscript appends what a peer signs to prove ownership of its
+// certificate. It binds the signature to the ephemeral keys of the session being
+// established such that it may not be replayed.
+func appendCertificateTranscript(dst, label, clientPub, serverPub []byte) []byte {
+	dst = append(dst, label...)
+	dst = append(dst, clientPub...)
+	dst = append(dst, serverPub...)
+	return dst
+}
+
+func writeCertificate(sc *SessionConn, cert *Certificate, key ed25519.PrivateKey, label, clientPub, serverPub []byte) error {
+	sig := ed25519.Sign(key, appendCertificateTranscript(nil, label, clientPub, serverPub))
+
+	_, err := sc.Write(append(cert.AppendTo(nil), sig...))
+	if err == nil {
+		err = sc.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return nil
+}
+
+func readCertificate(sc *SessionConn, ca ed25519.PublicKey, label, clientPub, serverPub []byte) (*Certificate, error) {
+	buf := make([]byte, maxCertificateFrameSize)
+	n, err := sc.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer certificate: %w", err)
+	}
+
+	cert, leftover, err := UnmarshalCertificate(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode peer certificate: %w", err)
+	}
+
+	err = cert.Verify(ca, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(leftover) != ed25519.SignatureSize ||
+		!ed25519.Verify(cert.PublicKey, appendCertificateTranscript(nil, label, clientPub, serverPub), leftover) {
+		return nil, fmt.Errorf("%w: peer does not own the private key to '%s'", ErrInvalidCertificate, cert.Subject)
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,188 @@
+package streaming_transmit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/lithdew/bytesutil"
+	"github.com/oasisprotocol/ed25519"
+)
+
+var (
+	ErrInvalidCertificate = errors.New("invalid certificate")
+	ErrCertificateExpired = errors.New("certificate expired")
+)
+
+// Certificate is a lightweight certificate binding an Ed25519 public key to a subject name
+// and a set of roles. Certificates are signed by a cluster certificate authority.
+type Certificate struct {
+	Subject   string
+	Roles     []string
+	Expiry    time.Time
+	PublicKey ed25519.PublicKey
+	Signature []byte
+}
+
+// HasRole returns true if the certificate grants the given role.
+func (c *Certificate) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendPayloadTo appends the portion of the certificate that is covered by its signature.
+func (c *Certificate) AppendPayloadTo(dst []byte) []byte {
+	dst = append(dst, uint8(len(c.Subject)))
+	dst = append(dst, c.Subject...)
+	dst = append(dst, uint8(len(c.Roles)))
+	for _, role := range c.Roles {
+		dst = append(dst, uint8(len(role)))
+		dst = append(dst, role...)
+	}
+	dst = bytesutil.AppendUint64BE(dst, uint64(c.Expiry.Unix()))
+	dst = append(dst, c.PublicKey...)
+	return dst
+}
+
+func (c *Certificate) AppendTo(dst []byte) []byte {
+	dst = c.AppendPayloadTo(dst)
+	dst = append(dst, c.Signature...)
+	return dst
+}
+
+func UnmarshalCertificate(buf []byte) (*Certificate, []byte, error) {
+	var cert Certificate
+
+	if len(buf) < 1 {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+	var size uint8
+	size, buf = buf[0], buf[1:]
+	if len(buf) < int(size) {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+	cert.Subject, buf = string(buf[:size]), buf[size:]
+
+	if len(buf) < 1 {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+	size, buf = buf[0], buf[1:]
+
+	cert.Roles = make([]string, size)
+	for i := 0; i < len(cert.Roles); i++ {
+		if len(buf) < 1 {
+			return nil, buf, io.ErrUnexpectedEOF
+		}
+		size, buf = buf[0], buf[1:]
+		if len(buf) < int(size) {
+			return nil, buf, io.ErrUnexpectedEOF
+		}
+		cert.Roles[i], buf = string(buf[:size]), buf[size:]
+	}
+
+	if len(buf) < 8+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+	cert.Expiry, buf = time.Unix(int64(bytesutil.Uint64BE(buf[:8])), 0), buf[8:]
+	cert.PublicKey, buf = append(ed25519.PublicKey(nil), buf[:ed25519.PublicKeySize]...), buf[ed25519.PublicKeySize:]
+	cert.Signature, buf = append([]byte(nil), buf[:ed25519.SignatureSize]...), buf[ed25519.SignatureSize:]
+
+	return &cert, buf, nil
+}
+
+// Verify checks that the certificate was signed by the certificate authority that holds the
+// private key to ca, and that it has not expired as of now.
+func (c *Certificate) Verify(ca ed25519.PublicKey, now time.Time) error {
+	if len(c.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: public key is %d byte(s)", ErrInvalidCertificate, len(c.PublicKey))
+	}
+	if len(ca) != ed25519.PublicKeySize || !ed25519.Verify(ca, c.AppendPayloadTo(nil), c.Signature) {
+		return fmt.Errorf("%w: '%s' is not signed by the certificate authority", ErrInvalidCertificate, c.Subject)
+	}
+	if !now.Before(c.Expiry) {
+		return fmt.Errorf("%w: '%s' expired at %s", ErrCertificateExpired, c.Subject, c.Expiry)
+	}
+	return nil
+}
+
+func (c *Certificate) validate() error {
+	if len(c.Subject) > math.MaxUint8 {
+		return fmt.Errorf("subject '%s' is too large - must be <= %d bytes", c.Subject, math.MaxUint8)
+	}
+	if len(c.Roles) > math.MaxUint8 {
+		return fmt.Errorf("too many roles - must be <= %d roles", math.MaxUint8)
+	}
+	size := 1 + len(c.Subject) + 1 + 8 + len(c.PublicKey) + ed25519.SignatureSize
+	for _, role := range c.Roles {
+		if len(role) > math.MaxUint8 {
+			return fmt.Errorf("role '%s' is too large - must be <= %d bytes", role, math.MaxUint8)
+		}
+		size += 1 + len(role)
+	}
+	if size > maxCertificateSize {
+		return fmt.Errorf("certificate is %d bytes encoded - must be <= %d bytes", size, maxCertificateSize)
+	}
+	return nil
+}
+
+// CertificateAuthority mints certificates for the peers of a cluster.
+type CertificateAuthority struct {
+	Certificate *Certificate
+	PrivateKey  ed25519.PrivateKey
+}
+
+// NewCertificateAuthority generates a new certificate authority key pair, along with a
+// self-signed certificate for it that expires after ttl.
+func NewCertificateAuthority(subject string, ttl time.Duration) (*CertificateAuthority, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	ca := &CertificateAuthority{PrivateKey: priv}
+	ca.Certificate, err = ca.Sign(subject, nil, pub, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// PublicKey returns the public key certificates minted by the certificate authority are
+// verified against.
+func (ca *CertificateAuthority) PublicKey() ed25519.PublicKey {
+	return ca.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// Sign mints a certificate for pub that expires after ttl.
+func (ca *CertificateAuthority) Sign(subject string, roles []string, pub ed25519.PublicKey, ttl time.Duration) (*Certificate, error) {
+	cert := &Certificate{
+		Subject:   subject,
+		Roles:     roles,
+		Expiry:    time.Now().Add(ttl).Truncate(time.Second),
+		PublicKey: pub,
+	}
+	err := cert.validate()
+	if err != nil {
+		return nil, err
+	}
+	cert.Signature = ed25519.Sign(ca.PrivateKey, cert.AppendPayloadTo(nil))
+	return cert, nil
+}
+
+// Issue generates a new leaf key pair, and mints a certificate for it that expires after ttl.
+func (ca *CertificateAuthority) Issue(subject string, roles []string, ttl time.Duration) (*Certificate, ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := ca.Sign(subject, roles, pub, ttl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, priv, nil
+}
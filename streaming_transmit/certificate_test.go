@@ -0,0 +1,135 @@
+package streaming_transmit
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestCertificate(t *testing.T) {
+	ca, err := NewCertificateAuthority("cluster", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, ca.Certificate.Verify(ca.PublicKey(), time.Now()))
+
+	cert, _, err := ca.Issue("billing", []string{"reader", "writer"}, time.Hour)
+	require.NoError(t, err)
+	require.True(t, cert.HasRole("writer"))
+	require.False(t, cert.HasRole("admin"))
+
+	actual, leftover, err := UnmarshalCertificate(cert.AppendTo(nil))
+	require.NoError(t, err)
+	require.Len(t, leftover, 0)
+	require.EqualValues(t, cert.Subject, actual.Subject)
+	require.EqualValues(t, cert.Roles, actual.Roles)
+	require.True(t, cert.Expiry.Equal(actual.Expiry))
+	require.NoError(t, actual.Verify(ca.PublicKey(), time.Now()))
+
+	require.True(t, errors.Is(actual.Verify(ca.PublicKey(), time.Now().Add(2*time.Hour)), ErrCertificateExpired))
+
+	other, err := NewCertificateAuthority("other", time.Hour)
+	require.NoError(t, err)
+	require.True(t, errors.Is(actual.Verify(other.PublicKey(), time.Now()), ErrInvalidCertificate))
+
+	actual.Roles = append(actual.Roles, "admin")
+	require.True(t, errors.Is(actual.Verify(ca.PublicKey(), time.Now()), ErrInvalidCertificate))
+
+	// certificates too large to be sent during a handshake may not be minted
+
+	roles := make([]string, math.MaxUint8)
+	for i := range roles {
+		roles[i] = strings.Repeat("r", math.MaxUint8)
+	}
+	_, _, err = ca.Issue("billing", roles, time.Hour)
+	require.Error(t, err)
+
+	cert, _, err = ca.Issue("billing", roles[:14], time.Hour)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(cert.AppendTo(nil)), maxCertificateSize)
+}
+
+func TestCertHandshakeUntrusted(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ca, err := NewCertificateAuthority("cluster", time.Hour)
+	require.NoError(t, err)
+	rogue, err := NewCertificateAuthority("rogue", time.Hour)
+	require.NoError(t, err)
+
+	serverCert, serverKey, err := ca.Issue("server", nil, time.Hour)
+	require.NoError(t, err)
+	clientCert, clientKey, err := rogue.Issue("client", []string{"admin"}, time.Hour)
+	require.NoError(t, err)
+
+	alice, bob := net.Pipe()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = CertClientHandshaker(clientCert, clientKey, ca.PublicKey())(alice)
+		alice.Close()
+	}()
+
+	_, err = CertServerHandshaker(serverCert, serverKey, ca.PublicKey())(bob)
+	require.True(t, errors.Is(err, ErrInvalidCertificate))
+	bob.Close()
+
+	wg.Wait()
+}
+
+func TestCertClientServer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ca, err := NewCertificateAuthority("cluster", time.Hour)
+	require.NoError(t, err)
+
+	serverCert, serverKey, err := ca.Issue("server", nil, time.Hour)
+	require.NoError(t, err)
+	clientCert, clientKey, err := ca.Issue("billing", []string{"writer"}, time.Hour)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{
+		Handshaker: CertServerHandshaker(serverCert, serverKey, ca.PublicKey()),
+		Handler: HandlerFunc(func(ctx *Context) error {
+			cert := ctx.PeerCertificate()
+			if cert == nil || !cert.HasRole("writer") {
+				return ctx.Reply([]byte("denied"))
+			}
+			return ctx.Reply([]byte(cert.Subject))
+		}),
+	}
+
+	client := &Client{
+		Addr:       ln.Addr().String(),
+		Handshaker: CertClientHandshaker(clientCert, clientKey, ca.PublicKey()),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	res, err := client.Request(nil, []byte("who am i?"))
+	require.NoError(t, err)
+	require.EqualValues(t, "billing", res)
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+	require.Equal(t, "server", conn.PeerCertificate().Subject)
+}
@@ -1,6 +1,8 @@
 package streaming_transmit
 
 import (
+	"context"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -29,6 +31,25 @@ type Client struct {
 	Handshaker       Handshaker
 	HandshakeTimeout time.Duration
 
+	// Trace, if set, is notified of the lifecycle of connections and messages, unless it is
+	// overridden by a ClientTrace attached to the context of a request with WithClientTrace.
+	Trace *ClientTrace
+
+	// Protocols, if not empty, lists the application protocols the client supports in order
+	// of preference. They are offered to the server right after the handshake, and the protocol
+	// it picks is reported by Conn.Protocol. Connecting fails with ErrNoCommonProtocol if the
+	// server supports none of them, or is not configured with Server.Protocols.
+	Protocols []string
+
+	// KeyLog, if set, records the session keys of all connections in a format that allows for
+	// captured traffic to be decrypted. It is meant for debugging, and compromises security.
+	KeyLog io.Writer
+
+	// Padding, if set, pads the messages of all connections once their handshake established a
+	// session. The server must be configured with Server.Padding as well. If only one side asks
+	// for padding, the other adopts its policy. Max defaults to ReadBufferSize.
+	Padding *PaddingPolicy
+
 	MaxConns        int
 	NumDialAttempts int
 
@@ -39,6 +60,14 @@ type Client struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// IdleTimeout closes connections once no application traffic was sent or received over
+	// them for the given duration. MaxConnAge gracefully recycles connections once they have
+	// been open for the given duration, randomly jittered by DefaultMaxConnAgeJitter, giving
+	// pending requests up to MaxConnAgeGrace to complete.
+	IdleTimeout     time.Duration
+	MaxConnAge      time.Duration
+	MaxConnAgeGrace time.Duration
+
 	SeqOffset uint32
 	SeqDelta  uint32
 
@@ -53,23 +82,87 @@ type Client struct {
 
 func (c *Client) Get() (*Conn, error) {
 	c.once.Do(c.init)
+	return c.get(context.Background(), c.Trace)
+}
 
-	cc := c.getClientConn()
+// get returns a conn to send a message over, dialing a new one if necessary. It stops waiting
+// for the conn to be established once ctx is done.
+func (c *Client) get(ctx context.Context, trace *ClientTrace) (*Conn, error) {
+	if trace != nil && trace.GetConn != nil {
+		trace.GetConn(c.Addr)
+	}
+
+	cc := c.getClientConn(trace)
 
-	<-cc.ready
+	select {
+	case <-cc.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	if cc.err != nil {
 		return nil, cc.err
 	}
+
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(cc.conn)
+	}
+
 	return cc.conn, nil
 }
 
+// getTrace returns the ClientTrace attached to ctx, or the ClientTrace of the client if there
+// is none.
+func (c *Client) getTrace(ctx context.Context) *ClientTrace {
+	if trace := ContextClientTrace(ctx); trace != nil {
+		return trace
+	}
+	return c.Trace
+}
+
+// SendContext sends buf and waits for it to be written. See Conn.SendContext.
+func (c *Client) SendContext(ctx context.Context, buf []byte) error {
+	c.once.Do(c.init)
+
+	trace := c.getTrace(ctx)
+
+	conn, err := c.get(ctx, trace)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	conn.once.Do(conn.init)
+	return conn.send(0, buf, trace)
+}
+
+// RequestContext sends a request and waits for its response. See Conn.RequestContext.
+func (c *Client) RequestContext(ctx context.Context, dst, buf []byte) ([]byte, error) {
+	c.once.Do(c.init)
+
+	trace := c.getTrace(ctx)
+
+	conn, err := c.get(ctx, trace)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn.once.Do(conn.init)
+	return conn.request(ctx, dst, buf, trace)
+}
+
 func (c *Client) Send(buf []byte) error {
 	conn, err := c.Get()
 	if err != nil {
 		return err
 	}
 
-	return conn.Send(buf)
+	conn.once.Do(conn.init)
+	return conn.send(0, buf, c.Trace)
 }
 
 func (c *Client) SendNoWait(buf []byte) error {
@@ -78,7 +171,8 @@ func (c *Client) SendNoWait(buf []byte) error {
 		return err
 	}
 
-	return conn.SendNoWait(buf)
+	conn.once.Do(conn.init)
+	return conn.sendNoWait(0, buf, c.Trace)
 }
 
 func (c *Client) Request(dst, buf []byte) ([]byte, error) {
@@ -87,7 +181,8 @@ func (c *Client) Request(dst, buf []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return conn.Request(dst, buf)
+	conn.once.Do(conn.init)
+	return conn.request(nil, dst, buf, c.Trace)
 }
 
 func (c *Client) NumOfPendingWrites() int {
@@ -128,7 +223,7 @@ func (c *Client) deleteClientConn(conn *clientConn) {
 	}
 }
 
-func (c *Client) newClientConn() *clientConn {
+func (c *Client) newClientConn(trace *ClientTrace) *clientConn {
 	cc := &clientConn{
 		ready: make(chan struct{}),
 		conn: &Conn{
@@ -139,6 +234,9 @@ func (c *Client) newClientConn() *clientConn {
 			WriteBufferSize: c.getWriteBufferSize(),
 			ReadTimeout:     c.getReadTimeout(),
 			WriteTimeout:    c.getWriteTimeout(),
+			IdleTimeout:     c.IdleTimeout,
+			MaxAge:          jitter(c.MaxConnAge),
+			MaxAgeGrace:     c.MaxConnAgeGrace,
 		},
 	}
 	c.conns = append(c.conns, cc)
@@ -154,12 +252,33 @@ func (c *Client) newClientConn() *clientConn {
 		)
 
 		for i := 0; i < c.getNumDialAttempts(); i++ {
+			if trace != nil && trace.DialStart != nil {
+				trace.DialStart("tcp", c.Addr)
+			}
 			conn, cc.err = dialer.Dial("tcp", c.Addr)
+			if trace != nil && trace.DialDone != nil {
+				trace.DialDone("tcp", c.Addr, cc.err)
+			}
 			if cc.err == nil {
 				cc.err = conn.SetDeadline(time.Now().Add(c.getHandshakeTimeout()))
 			}
 			if cc.err == nil {
+				if trace != nil && trace.HandshakeStart != nil {
+					trace.HandshakeStart()
+				}
 				bufConn, cc.err = c.getHandshaker().Handshake(conn)
+				if cc.err == nil && c.KeyLog != nil {
+					cc.err = writeKeyLog(c.KeyLog, bufConn)
+				}
+				if cc.err == nil && c.Padding != nil {
+					cc.err = negotiatePadding(bufConn, *c.Padding, c.getReadBufferSize(), true)
+				}
+				if cc.err == nil && len(c.Protocols) > 0 {
+					cc.conn.protocol, cc.err = negotiateProtocol(bufConn, c.Protocols)
+				}
+				if trace != nil && trace.HandshakeDone != nil {
+					trace.HandshakeDone(cc.err)
+				}
 			}
 			if cc.err == nil {
 				cc.err = conn.SetDeadline(zeroTime)
@@ -177,6 +296,8 @@ func (c *Client) newClientConn() *clientConn {
 			return
 		}
 
+		cc.conn.bc = bufConn
+
 		close(cc.ready)
 
 		c.getConnStateHandler().HandleConnState(cc.conn, StateNew)
@@ -189,31 +310,36 @@ func (c *Client) newClientConn() *clientConn {
 	return cc
 }
 
-func (c *Client) getClientConn() *clientConn {
+func (c *Client) getClientConn(trace *ClientTrace) *clientConn {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if len(c.conns) == 0 {
-		return c.newClientConn()
-	}
+	// Conns that are draining are not picked for new messages, and do not count towards
+	// MaxConns as they are about to be closed.
+
+	var (
+		mc *clientConn
+		mp int
+		n  int
+	)
+
+	for _, cc := range c.conns {
+		if cc.conn.Draining() {
+			continue
+		}
+		n++
 
-	mc := c.conns[0]
-	mp := mc.conn.NumOfPendingWrites()
-	if mp == 0 {
-		return mc
-	}
-	for i := 1; i < len(c.conns); i++ {
-		cc := c.conns[i]
 		cp := cc.conn.NumOfPendingWrites()
 		if cp == 0 {
 			return cc
 		}
-		if cp < mp {
+		if mc == nil || cp < mp {
 			mc, mp = cc, cp
 		}
 	}
-	if len(c.conns) < c.getMaxConns() {
-		return c.newClientConn()
+
+	if mc == nil || n < c.getMaxConns() {
+		return c.newClientConn(trace)
 	}
 	return mc
 }
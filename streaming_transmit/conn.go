@@ -1,9 +1,14 @@
 package streaming_transmit
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 	"time"
 
@@ -20,7 +25,18 @@ var DefaultWriteTimeout = 3 * time.Second
 var DefaultSeqOffset uint32 = 1
 var DefaultSeqDelta uint32 = 2
 
+// DefaultCanceledRequestExpiry is how long the response to a request that is no longer waited
+// on is expected to arrive within. Late responses are dropped, while responses that arrive
+// even later are mistaken for messages from the peer.
+var DefaultCanceledRequestExpiry = 1 * time.Minute
+
+var ErrConnClosed = errors.New("conn closed")
+var ErrConnClosedByPeer = errors.New("conn closed by peer")
+
 type Conn struct {
+	stats  ConnStats // must be first for 64-bit alignment of atomic counters
+	active int64     // unix nanoseconds of the last application traffic
+
 	Handler Handler
 
 	ReadBufferSize  int
@@ -29,18 +45,105 @@ type Conn struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// IdleTimeout closes the Conn once no application traffic was sent or received over it for
+	// the given duration. MaxAge recycles the Conn once it has been open for the given duration,
+	// giving pending requests up to MaxAgeGrace to complete.
+	IdleTimeout time.Duration
+	MaxAge      time.Duration
+	MaxAgeGrace time.Duration
+
 	SeqOffset uint32
 	SeqDelta  uint32
 
 	mu   sync.Mutex
 	once sync.Once
 
+	bc       BufferedConn // underlying connection returned by a Handshaker
+	protocol string       // application protocol negotiated after the handshake
+
+	limiters []*rateLimiter // rate limits messages handled from the peer are subject to
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	reason    error // reason the Conn was closed for with Close
+
+	draining    bool // set once the Conn is being recycled
+	drainedSent bool // set once the peer was told there are no pending requests left
+	peerDrained bool // set once the peer told there are no pending requests left
+
 	writerQueue []*pendingWrite
 	writerCond  sync.Cond
 	writerDone  bool
 
-	reqs map[uint32]*pendingRequest
-	seq  uint32
+	reqs     map[uint32]*pendingRequest
+	canceled map[uint32]time.Time // requests no longer waited on, whose responses are dropped
+	swept    time.Time            // last time expired requests were removed from canceled
+	seq      uint32
+}
+
+// BufferedConn returns the connection returned by the Handshaker this Conn was established
+// with. It may be type asserted to learn about how the session was established, e.g. the
+// pre-shared key a peer authenticated with when it is a *PSKSessionConn.
+func (c *Conn) BufferedConn() BufferedConn {
+	return c.bc
+}
+
+// LocalAddr returns the local address of the Conn, or nil if it was not established yet.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.bc == nil {
+		return nil
+	}
+	return c.bc.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the Conn, or nil if it was not established yet.
+// For connections accepted through a trusted proxy, it is the address of the actual client.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.bc == nil {
+		return nil
+	}
+	return c.bc.RemoteAddr()
+}
+
+// PeerCertificate returns the certificate the peer proved ownership of while establishing
+// this Conn, or nil if the Handshaker this Conn was established with does not verify peers
+// against a cluster certificate authority.
+func (c *Conn) PeerCertificate() *Certificate {
+	bc, ok := c.bc.(interface{ PeerCertificate() *Certificate })
+	if !ok {
+		return nil
+	}
+	return bc.PeerCertificate()
+}
+
+// PeerCertificateChain returns the certificate chain presented by the peer, or nil if the
+// Conn was not established over TLS.
+func (c *Conn) PeerCertificateChain() []*x509.Certificate {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// TLSConnectionState returns details about the TLS connection the Conn was established over.
+// It reports false if the Conn was not established over TLS.
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	bc, ok := c.bc.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return bc.ConnectionState(), true
+}
+
+// SessionStats returns the traffic counters of the SessionConn the Conn was established over.
+// It reports false if the Conn was not established over a SessionConn.
+func (c *Conn) SessionStats() (SessionStats, bool) {
+	bc, ok := c.bc.(interface{ Stats() SessionStats })
+	if !ok {
+		return SessionStats{}, false
+	}
+	return bc.Stats(), true
 }
 
 func (c *Conn) NumOfPendingWrites() int {
@@ -58,25 +161,39 @@ func (c *Conn) Handle(done chan struct{}, conn BufferedConn) error {
 		close(writerDone)
 	}()
 
+	stop := make(chan struct{})
+
 	readerDone := make(chan error)
 	go func() {
-		readerDone <- c.readLoop(conn)
+		readerDone <- c.readLoop(conn, stop)
 		close(readerDone)
 	}()
 
+	if c.IdleTimeout > 0 || c.MaxAge > 0 {
+		c.touch()
+
+		lifetimeStop, lifetimeDone := make(chan struct{}), make(chan struct{})
+		go func() {
+			c.lifetime(lifetimeStop)
+			close(lifetimeDone)
+		}()
+
+		defer func() {
+			close(lifetimeStop)
+			<-lifetimeDone
+		}()
+	}
+
 	var err error
 
 	select {
 	case <-done:
-		c.closeWriter()
-		err = <-writerDone
-		_ = conn.Close()
-		if err == nil {
-			err = <-readerDone
-		} else {
-			<-readerDone
-		}
+		err = c.stopLoops(conn, stop, writerDone, readerDone)
+	case <-c.closed:
+		_ = c.stopLoops(conn, stop, writerDone, readerDone)
+		err = c.reason
 	case err = <-writerDone:
+		close(stop)
 		c.closeWriter()
 		_ = conn.Close()
 		if err == nil {
@@ -97,24 +214,95 @@ func (c *Conn) Handle(done chan struct{}, conn BufferedConn) error {
 	return err
 }
 
-func (c *Conn) Send(payload []byte) error       { c.once.Do(c.init); return c.send(0, payload) }
-func (c *Conn) SendNoWait(payload []byte) error { c.once.Do(c.init); return c.sendNoWait(0, payload) }
+// stopLoops stops reading from conn, and closes it once all pending writes are flushed.
+func (c *Conn) stopLoops(conn BufferedConn, stop chan struct{}, writerDone, readerDone chan error) error {
+	close(stop)
+	c.closeWriter()
+	err := <-writerDone
+	_ = conn.Close()
+	if err == nil {
+		err = <-readerDone
+	} else {
+		<-readerDone
+	}
+	return err
+}
+
+// Close closes the Conn for the given reason, which is sent to the peer beforehand. Pending
+// requests fail with an error wrapping reason, or ErrConnClosed if reason is nil. Close may
+// be called several times, of which only the first call has any effect.
+func (c *Conn) Close(reason error) {
+	c.once.Do(c.init)
+
+	c.closeOnce.Do(func() {
+		if reason == nil {
+			reason = ErrConnClosed
+		}
+		c.reason = reason
+
+		_ = c.sendControl(controlClose, 0, reason.Error())
+
+		close(c.closed)
+	})
+}
+
+func (c *Conn) Send(payload []byte) error {
+	c.once.Do(c.init)
+	return c.send(0, payload, nil)
+}
+
+func (c *Conn) SendNoWait(payload []byte) error {
+	c.once.Do(c.init)
+	return c.sendNoWait(0, payload, nil)
+}
+
+// SendContext sends payload and waits for it to be written, notifying the ClientTrace attached
+// to ctx with WithClientTrace. Payload is not sent if ctx is already done.
+func (c *Conn) SendContext(ctx context.Context, payload []byte) error {
+	c.once.Do(c.init)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.send(0, payload, ContextClientTrace(ctx))
+}
 
 func (c *Conn) Request(dst []byte, payload []byte) ([]byte, error) {
 	c.once.Do(c.init)
+	return c.request(nil, dst, payload, nil)
+}
+
+// RequestContext sends a request and waits for its response, notifying the ClientTrace
+// attached to ctx with WithClientTrace. It stops waiting for the response with the error of ctx
+// once ctx is done.
+func (c *Conn) RequestContext(ctx context.Context, dst []byte, payload []byte) ([]byte, error) {
+	c.once.Do(c.init)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.request(ctx, dst, payload, ContextClientTrace(ctx))
+}
 
+// request sends a request and waits for its response. If ctx is not nil, it stops waiting once
+// ctx is done.
+func (c *Conn) request(ctx context.Context, dst []byte, payload []byte, trace *ClientTrace) ([]byte, error) {
 	pr := pendingRequestPool.acquire(dst)
 	defer pendingRequestPool.release(pr)
 
+	pr.trace = trace
 	pr.wg.Add(1)
 
 	seq := c.next()
 
+	// the request may reuse the seq of a request that was canceled long ago
+
 	c.mu.Lock()
 	c.reqs[seq] = pr
+	delete(c.canceled, seq)
 	c.mu.Unlock()
 
-	err := c.sendNoWait(seq, payload)
+	err := c.sendNoWait(seq, payload, trace)
 
 	if err != nil {
 		pr.wg.Done()
@@ -125,17 +313,71 @@ func (c *Conn) Request(dst []byte, payload []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	pr.wg.Wait()
+	if ctx == nil || ctx.Done() == nil {
+		pr.wg.Wait()
+		return pr.dst, pr.err
+	}
+
+	received := make(chan struct{})
+	go func() {
+		pr.wg.Wait()
+		close(received)
+	}()
+
+	select {
+	case <-received:
+	case <-ctx.Done():
+		c.mu.Lock()
+		_, pending := c.reqs[seq]
+		if pending {
+			delete(c.reqs, seq)
+			c.cancel(seq, time.Now())
+		}
+		c.mu.Unlock()
+
+		// If the request is no longer pending, its response is being received.
+
+		if pending {
+			pr.err = ctx.Err()
+			pr.wg.Done()
+
+			c.checkDrained()
+		}
+		<-received
+	}
 
 	return pr.dst, pr.err
 }
 
+// cancel records that the response to the request sent with seq is no longer waited on, and
+// forgets about requests canceled longer than DefaultCanceledRequestExpiry ago. It must be
+// called with the lock of the Conn held.
+func (c *Conn) cancel(seq uint32, now time.Time) {
+	c.canceled[seq] = now
+
+	if now.Sub(c.swept) < DefaultCanceledRequestExpiry {
+		return
+	}
+	c.swept = now
+
+	for seq, at := range c.canceled {
+		if now.Sub(at) >= DefaultCanceledRequestExpiry {
+			delete(c.canceled, seq)
+		}
+	}
+}
+
 func (c *Conn) init() {
 	c.reqs = make(map[uint32]*pendingRequest)
+	c.canceled = make(map[uint32]time.Time)
+	c.swept = time.Now()
 	c.writerCond.L = &c.mu
+	c.closed = make(chan struct{})
 }
 
-func (c *Conn) send(seq uint32, payload []byte) error {
+func (c *Conn) send(seq uint32, payload []byte, trace *ClientTrace) error {
+	c.touch()
+
 	buf := bytebufferpool.Get()
 	defer bytebufferpool.Put(buf)
 
@@ -143,19 +385,23 @@ func (c *Conn) send(seq uint32, payload []byte) error {
 	binary.BigEndian.PutUint32(buf.B[:4], seq)
 	copy(buf.B[4:], payload)
 
-	return c.write(buf)
+	return c.write(buf, trace)
 }
 
-func (c *Conn) sendNoWait(seq uint32, payload []byte) error {
+func (c *Conn) sendNoWait(seq uint32, payload []byte, trace *ClientTrace) error {
+	if seq != controlSeq {
+		c.touch()
+	}
+
 	buf := bytebufferpool.Get()
 	buf.B = bytesutil.ExtendSlice(buf.B, 4+len(payload))
 	binary.BigEndian.PutUint32(buf.B[:4], seq)
 	copy(buf.B[4:], payload)
-	return c.writeNoWait(buf)
+	return c.writeNoWait(buf, trace)
 }
 
-func (c *Conn) write(buf *bytebufferpool.ByteBuffer) error {
-	pw, err := c.preparePendingWrite(buf, true)
+func (c *Conn) write(buf *bytebufferpool.ByteBuffer, trace *ClientTrace) error {
+	pw, err := c.preparePendingWrite(buf, true, trace)
 	if err != nil {
 		return err
 	}
@@ -164,20 +410,24 @@ func (c *Conn) write(buf *bytebufferpool.ByteBuffer) error {
 	return pw.err
 }
 
-func (c *Conn) writeNoWait(buf *bytebufferpool.ByteBuffer) error {
-	_, err := c.preparePendingWrite(buf, false)
+func (c *Conn) writeNoWait(buf *bytebufferpool.ByteBuffer, trace *ClientTrace) error {
+	_, err := c.preparePendingWrite(buf, false, trace)
 	return err
 }
 
-func (c *Conn) preparePendingWrite(buf *bytebufferpool.ByteBuffer, wait bool) (*pendingWrite, error) {
+func (c *Conn) preparePendingWrite(buf *bytebufferpool.ByteBuffer, wait bool, trace *ClientTrace) (*pendingWrite, error) {
+	seq := bytesutil.Uint32BE(buf.B[:4])
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
 
 	if c.writerDone {
+		c.mu.Unlock()
 		return nil, fmt.Errorf("node is shut down: %w", io.EOF)
 	}
 
 	pw := pendingWritePool.acquire(buf, wait)
+	pw.seq = seq
+	pw.trace = trace
 	if wait {
 		pw.wg.Add(1)
 	}
@@ -185,6 +435,12 @@ func (c *Conn) preparePendingWrite(buf *bytebufferpool.ByteBuffer, wait bool) (*
 	c.writerQueue = append(c.writerQueue, pw)
 	c.writerCond.Signal()
 
+	c.mu.Unlock()
+
+	if trace != nil && trace.WriteQueued != nil {
+		trace.WriteQueued(seq)
+	}
+
 	return pw, nil
 }
 
@@ -253,11 +509,15 @@ func (c *Conn) next() uint32 {
 	} else {
 		c.seq += c.getSeqDelta()
 	}
+	if c.seq == controlSeq {
+		c.seq += c.getSeqDelta()
+	}
 	return c.seq
 }
 
 func (c *Conn) writeLoop(conn BufferedConn) error {
 	var queue []*pendingWrite
+	var flushes []pendingFlush
 	var err error
 
 	for {
@@ -281,10 +541,18 @@ func (c *Conn) writeLoop(conn BufferedConn) error {
 			break
 		}
 
+		flushes = flushes[:0]
+		for _, pw := range queue {
+			if pw.trace != nil && pw.trace.Flushed != nil {
+				flushes = append(flushes, pendingFlush{seq: pw.seq, trace: pw.trace})
+			}
+		}
+
 		timeout := c.getWriteTimeout()
 		if timeout > 0 {
 			err = conn.SetWriteDeadline(time.Now().Add(timeout))
 			if err != nil {
+				traceFlushed(flushes, err)
 				for _, pw := range queue {
 					if pw.wait {
 						pw.err = err
@@ -312,10 +580,12 @@ func (c *Conn) writeLoop(conn BufferedConn) error {
 		}
 
 		if err != nil {
+			traceFlushed(flushes, err)
 			break
 		}
 
 		err = conn.Flush()
+		traceFlushed(flushes, err)
 		if err != nil {
 			break
 		}
@@ -328,7 +598,7 @@ func (c *Conn) writeLoop(conn BufferedConn) error {
 	return err
 }
 
-func (c *Conn) readLoop(conn BufferedConn) error {
+func (c *Conn) readLoop(conn BufferedConn, stop <-chan struct{}) error {
 	buf := make([]byte, c.getReadBufferSize())
 
 	var (
@@ -359,14 +629,32 @@ func (c *Conn) readLoop(conn BufferedConn) error {
 		seq := bytesutil.Uint32BE(data)
 		data = data[4:]
 
+		if seq == controlSeq {
+			c.handleControl(data)
+			continue
+		}
+
+		c.touch()
+
 		c.mu.Lock()
 		pr, exists := c.reqs[seq]
 		if exists {
 			delete(c.reqs, seq)
 		}
+		_, canceled := c.canceled[seq]
+		if canceled {
+			delete(c.canceled, seq)
+		}
 		c.mu.Unlock()
 
+		if canceled {
+			continue
+		}
+
 		if seq == 0 || !exists {
+			if !c.throttle(seq, len(data), stop) {
+				continue
+			}
 			err = c.call(seq, data)
 			if err != nil {
 				err = fmt.Errorf("handler encountered an error: %w", err)
@@ -380,7 +668,13 @@ func (c *Conn) readLoop(conn BufferedConn) error {
 		pr.dst = bytesutil.ExtendSlice(pr.dst, len(data))
 		copy(pr.dst, data)
 
+		if pr.trace != nil && pr.trace.ResponseReceived != nil {
+			pr.trace.ResponseReceived(seq)
+		}
+
 		pr.wg.Done()
+
+		c.checkDrained()
 	}
 
 	return fmt.Errorf("read_loop: %w", err)
@@ -416,5 +710,9 @@ func (c *Conn) close(err error) {
 		delete(c.reqs, seq)
 	}
 
+	for seq := range c.canceled {
+		delete(c.canceled, seq)
+	}
+
 	c.seq = 0
 }
@@ -8,4 +8,8 @@ type Context struct {
 
 func (c *Context) Conn() *Conn            { return c.conn }
 func (c *Context) Body() []byte           { return c.buf }
-func (c *Context) Reply(buf []byte) error { return c.conn.send(c.seq, buf) }
+func (c *Context) Reply(buf []byte) error { return c.conn.send(c.seq, buf, nil) }
+
+// PeerCertificate returns the verified certificate of the peer that sent this message, or nil
+// if the peer was not verified against a cluster certificate authority.
+func (c *Context) PeerCertificate() *Certificate { return c.conn.PeerCertificate() }
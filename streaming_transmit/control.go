@@ -0,0 +1,97 @@
+package streaming_transmit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/lithdew/bytesutil"
+)
+
+// ErrRequestRejected is returned by requests that a peer refused to handle, e.g. because they
+// exceeded its rate limits.
+var ErrRequestRejected = errors.New("request rejected by peer")
+
+// controlSeq is the sequence number of control frames, which are never dispatched to handlers.
+const controlSeq uint32 = math.MaxUint32
+
+// Kinds of control frames, which are laid out as [u8 kind][u32 seq][message]. controlReject
+// rejects the request sent with seq, and controlClose announces the Conn is being closed.
+// controlGoAway asks the peer to stop sending new messages over the Conn so that it may be
+// recycled, and controlDrained announces there are no pending requests left. controlProtocol
+// carries the protocols offered by a client, or the one picked by a server.
+const (
+	controlReject   byte = 1
+	controlClose    byte = 2
+	controlGoAway   byte = 3
+	controlDrained  byte = 4
+	controlProtocol byte = 5
+)
+
+// reject tells the peer that the request sent with seq will not be handled.
+func (c *Conn) reject(seq uint32, message string) error {
+	return c.sendControl(controlReject, seq, message)
+}
+
+func (c *Conn) sendControl(kind byte, seq uint32, message string) error {
+	payload := make([]byte, 0, 5+len(message))
+	payload = append(payload, kind)
+	payload = bytesutil.AppendUint32BE(payload, seq)
+	payload = append(payload, message...)
+	return c.sendNoWait(controlSeq, payload, nil)
+}
+
+// handleControl handles a control frame sent by the peer. Unknown control frames are ignored.
+func (c *Conn) handleControl(data []byte) {
+	if len(data) < 5 {
+		return
+	}
+
+	kind, seq, message := data[0], bytesutil.Uint32BE(data[1:5]), data[5:]
+
+	switch kind {
+	case controlReject:
+		c.mu.Lock()
+		pr, exists := c.reqs[seq]
+		if exists {
+			delete(c.reqs, seq)
+		}
+		delete(c.canceled, seq)
+		c.mu.Unlock()
+
+		if !exists {
+			return
+		}
+
+		pr.err = fmt.Errorf("%w: %s", ErrRequestRejected, message)
+		pr.wg.Done()
+
+		c.checkDrained()
+	case controlGoAway:
+		c.mu.Lock()
+		c.draining = true
+		c.mu.Unlock()
+
+		c.checkDrained()
+	case controlDrained:
+		c.mu.Lock()
+		c.peerDrained = true
+		c.mu.Unlock()
+
+		c.checkDrained()
+	case controlProtocol:
+		// the peer offered protocols, but this side was not configured to negotiate any
+
+		_ = c.sendControl(controlProtocol, 0, string([]byte{0}))
+	case controlClose:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		for seq, pr := range c.reqs {
+			pr.err = fmt.Errorf("%w: %s", ErrConnClosedByPeer, message)
+			pr.wg.Done()
+
+			delete(c.reqs, seq)
+		}
+	}
+}
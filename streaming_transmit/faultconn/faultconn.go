@@ -0,0 +1,299 @@
+// Package faultconn injects faults into connections established by a streaming_transmit Client
+// or Server, such as latency, limited bandwidth, failing reads and writes, abrupt resets and
+// stalled handshakes. Faults are driven by seeded random number generators, one for each
+// direction of a connection such that the faults injected into reads do not depend on how they
+// interleave with writes, which makes tests that use them deterministic.
+package faultconn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	st "github.com/TheSmallBoat/carlo/streaming_transmit"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+// Config configures the faults injected into a connection. Faults that are zero are disabled.
+type Config struct {
+	// Seed seeds the random number generators that decide when probabilistic faults occur.
+	Seed int64
+
+	// Latency delays every write by the given duration, randomly lengthened or shortened by
+	// up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Bandwidth limits the number of bytes read and written per second.
+	Bandwidth int
+
+	// FailReadAfter and FailWriteAfter fail reads and writes with ErrInjected once the given
+	// number of bytes have been read or written.
+	FailReadAfter  int64
+	FailWriteAfter int64
+
+	// ResetProbability is the probability of every read or write abruptly closing the
+	// connection and failing with ErrInjected.
+	ResetProbability float64
+
+	// HandshakeStall stalls handshakes for the given duration before they start, with
+	// probability HandshakeStallProbability. If HandshakeStallProbability is zero, every
+	// handshake is stalled.
+	HandshakeStall            time.Duration
+	HandshakeStallProbability float64
+}
+
+// Conn is a net.Conn that injects faults into reads and writes.
+type Conn struct {
+	net.Conn
+
+	cfg Config
+
+	reads  source // decides on faults injected into reads
+	writes source // decides on faults injected into writes and flushes
+
+	read    int64
+	written int64
+}
+
+// source is a random number generator that decides on the faults injected in one direction of
+// a connection.
+type source struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newSource(seed int64) source {
+	return source{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (s *source) chance(p float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64() < p
+}
+
+func (s *source) int63n(n int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Int63n(n)
+}
+
+// Wrap returns conn with faults injected according to cfg. Reads are driven by a random number
+// generator seeded with cfg.Seed, and writes by one seeded with cfg.Seed+1.
+func Wrap(conn net.Conn, cfg Config) *Conn {
+	return &Conn{Conn: conn, cfg: cfg, reads: newSource(cfg.Seed), writes: newSource(cfg.Seed + 1)}
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *Conn) BytesRead() int64 { return atomic.LoadInt64(&c.read) }
+
+// BytesWritten returns the number of bytes written to the connection.
+func (c *Conn) BytesWritten() int64 { return atomic.LoadInt64(&c.written) }
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.reset(&c.reads) {
+		return 0, fmt.Errorf("%w: connection reset while reading", ErrInjected)
+	}
+
+	b, limited := limit(b, c.cfg.FailReadAfter, atomic.LoadInt64(&c.read))
+	if limited && len(b) == 0 {
+		return 0, fmt.Errorf("%w: read failed after %d bytes", ErrInjected, c.cfg.FailReadAfter)
+	}
+
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	c.throttle(n)
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.reset(&c.writes) {
+		return 0, fmt.Errorf("%w: connection reset while writing", ErrInjected)
+	}
+
+	if delay := c.latency(); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	w, limited := limit(b, c.cfg.FailWriteAfter, atomic.LoadInt64(&c.written))
+
+	n, err := c.Conn.Write(w)
+	atomic.AddInt64(&c.written, int64(n))
+	c.throttle(n)
+
+	if err == nil && limited {
+		err = fmt.Errorf("%w: write failed after %d bytes", ErrInjected, c.cfg.FailWriteAfter)
+	}
+	return n, err
+}
+
+// limit truncates b such that at most max bytes are transferred in total, given that done
+// bytes were transferred so far. It reports whether b was truncated.
+func limit(b []byte, max, done int64) ([]byte, bool) {
+	if max <= 0 {
+		return b, false
+	}
+	left := max - done
+	if left < 0 {
+		left = 0
+	}
+	if int64(len(b)) <= left {
+		return b, false
+	}
+	return b[:left], true
+}
+
+// reset decides with src whether the connection is to be reset, and closes it if so. TCP
+// connections are closed with an RST rather than a FIN.
+func (c *Conn) reset(src *source) bool {
+	if c.cfg.ResetProbability <= 0 || !src.chance(c.cfg.ResetProbability) {
+		return false
+	}
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = c.Conn.Close()
+	return true
+}
+
+func (c *Conn) latency() time.Duration {
+	if c.cfg.Latency <= 0 {
+		return 0
+	}
+	if c.cfg.Jitter <= 0 {
+		return c.cfg.Latency
+	}
+
+	return c.cfg.Latency + time.Duration(c.writes.int63n(int64(2*c.cfg.Jitter+1))) - c.cfg.Jitter
+}
+
+func (c *Conn) throttle(n int) {
+	if c.cfg.Bandwidth <= 0 || n <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(c.cfg.Bandwidth))
+}
+
+// BufferedConn is a st.BufferedConn that injects faults into flushes, on top of the faults
+// injected into the connection it was established over.
+type BufferedConn struct {
+	st.BufferedConn
+
+	conn *Conn
+
+	readFailed  int32 // set once a read failed per FailReadAfter
+	writeFailed int32 // set once a write failed per FailWriteAfter
+}
+
+// WrapBuffered returns conn with faults injected according to cfg. As the connection conn was
+// established over is out of reach, faults are injected on messages as they are written to and
+// read from conn, rather than on the bytes that go over the wire. FailReadAfter and
+// FailWriteAfter fail the first message that would cross them as a whole, rather than
+// truncating it, along with every message after it.
+func WrapBuffered(conn st.BufferedConn, cfg Config) *BufferedConn {
+	return &BufferedConn{BufferedConn: conn, conn: Wrap(conn, cfg)}
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	if c.conn.reset(&c.conn.reads) {
+		return 0, fmt.Errorf("%w: connection reset while reading", ErrInjected)
+	}
+	if atomic.LoadInt32(&c.readFailed) == 1 {
+		return 0, fmt.Errorf("%w: read failed after %d bytes", ErrInjected, c.conn.cfg.FailReadAfter)
+	}
+
+	n, err := c.BufferedConn.Read(b)
+	if err != nil {
+		return n, err
+	}
+
+	if exceeds(c.conn.cfg.FailReadAfter, atomic.LoadInt64(&c.conn.read), n) {
+		atomic.StoreInt32(&c.readFailed, 1)
+		return 0, fmt.Errorf("%w: read failed after %d bytes", ErrInjected, c.conn.cfg.FailReadAfter)
+	}
+
+	atomic.AddInt64(&c.conn.read, int64(n))
+	c.conn.throttle(n)
+
+	return n, nil
+}
+
+func (c *BufferedConn) Write(b []byte) (int, error) {
+	if c.conn.reset(&c.conn.writes) {
+		return 0, fmt.Errorf("%w: connection reset while writing", ErrInjected)
+	}
+
+	if delay := c.conn.latency(); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if atomic.LoadInt32(&c.writeFailed) == 1 ||
+		exceeds(c.conn.cfg.FailWriteAfter, atomic.LoadInt64(&c.conn.written), len(b)) {
+		atomic.StoreInt32(&c.writeFailed, 1)
+		return 0, fmt.Errorf("%w: write failed after %d bytes", ErrInjected, c.conn.cfg.FailWriteAfter)
+	}
+
+	n, err := c.BufferedConn.Write(b)
+	atomic.AddInt64(&c.conn.written, int64(len(b)))
+	c.conn.throttle(len(b))
+
+	return n, err
+}
+
+// BytesRead returns the number of bytes of the messages read from the connection.
+func (c *BufferedConn) BytesRead() int64 { return c.conn.BytesRead() }
+
+// BytesWritten returns the number of bytes of the messages written to the connection.
+func (c *BufferedConn) BytesWritten() int64 { return c.conn.BytesWritten() }
+
+// exceeds reports whether transferring a message of n bytes crosses max, given that done bytes
+// were transferred so far.
+func exceeds(max, done int64, n int) bool {
+	return max > 0 && done+int64(n) > max
+}
+
+func (c *BufferedConn) Flush() error {
+	if c.conn.reset(&c.conn.writes) {
+		return fmt.Errorf("%w: connection reset while flushing", ErrInjected)
+	}
+	return c.BufferedConn.Flush()
+}
+
+// Handshaker wraps h such that faults are injected into every connection it establishes,
+// including during the handshake itself. Every connection gets its own random number
+// generator, seeded by cfg.Seed plus the number of connections established before it.
+type Handshaker struct {
+	h   st.Handshaker
+	cfg Config
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	conns int64
+}
+
+func NewHandshaker(h st.Handshaker, cfg Config) *Handshaker {
+	return &Handshaker{h: h, cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+func (h *Handshaker) Handshake(conn net.Conn) (st.BufferedConn, error) {
+	h.mu.Lock()
+	cfg := h.cfg
+	cfg.Seed += h.conns
+	h.conns++
+	stall := cfg.HandshakeStall > 0 &&
+		(cfg.HandshakeStallProbability <= 0 || h.rng.Float64() < cfg.HandshakeStallProbability)
+	h.mu.Unlock()
+
+	if stall {
+		time.Sleep(cfg.HandshakeStall)
+	}
+
+	return h.h.Handshake(Wrap(conn, cfg))
+}
@@ -0,0 +1,225 @@
+package faultconn
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	st "github.com/TheSmallBoat/carlo/streaming_transmit"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func pipe(cfg Config) (*Conn, net.Conn, func()) {
+	alice, bob := net.Pipe()
+	return Wrap(alice, cfg), bob, func() {
+		alice.Close()
+		bob.Close()
+	}
+}
+
+func TestFailWriteAfter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn, peer, closePipe := pipe(Config{FailWriteAfter: 4})
+	defer closePipe()
+
+	go func() { _, _ = io.Copy(ioutil.Discard, peer) }()
+
+	n, err := conn.Write([]byte("hello world"))
+	require.True(t, errors.Is(err, ErrInjected), err)
+	require.Equal(t, 4, n)
+
+	n, err = conn.Write([]byte("hello world"))
+	require.True(t, errors.Is(err, ErrInjected), err)
+	require.Equal(t, 0, n)
+	require.EqualValues(t, 4, conn.BytesWritten())
+}
+
+func TestFailReadAfter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn, peer, closePipe := pipe(Config{FailReadAfter: 4})
+	defer closePipe()
+
+	go func() { _, _ = peer.Write([]byte("hello world")) }()
+
+	buf := make([]byte, 16)
+
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.EqualValues(t, "hell", buf[:n])
+
+	_, err = conn.Read(buf)
+	require.True(t, errors.Is(err, ErrInjected), err)
+}
+
+func TestLatency(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn, peer, closePipe := pipe(Config{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	defer closePipe()
+
+	go func() { _, _ = io.Copy(ioutil.Discard, peer) }()
+
+	start := time.Now()
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestResetsAreDeterministic(t *testing.T) {
+	a, _, closeA := pipe(Config{Seed: 42})
+	defer closeA()
+
+	b, _, closeB := pipe(Config{Seed: 42})
+	defer closeB()
+
+	for i := 0; i < 100; i++ {
+		require.Equal(t, a.reads.chance(0.5), b.reads.chance(0.5))
+	}
+
+	// faults injected into writes do not depend on how many reads happened before them
+
+	c, _, closeC := pipe(Config{Seed: 42})
+	defer closeC()
+
+	for i := 0; i < 100; i++ {
+		require.Equal(t, a.writes.chance(0.5), c.writes.chance(0.5))
+	}
+}
+
+// bufferedConn is a st.BufferedConn over a connection that needs no flushing.
+type bufferedConn struct {
+	net.Conn
+}
+
+func (bufferedConn) Flush() error { return nil }
+
+func TestWrapBufferedFailsWholeMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	conn := WrapBuffered(bufferedConn{alice}, Config{FailWriteAfter: 8, FailReadAfter: 8})
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := bob.Read(buf)
+		received <- buf[:n]
+	}()
+
+	// a message that would cross the limit is not written at all, and neither is any message
+	// after it
+
+	n, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.EqualValues(t, "hello", <-received)
+
+	n, err = conn.Write([]byte("world"))
+	require.True(t, errors.Is(err, ErrInjected), err)
+	require.Equal(t, 0, n)
+
+	n, err = conn.Write([]byte("!"))
+	require.True(t, errors.Is(err, ErrInjected), err)
+	require.Equal(t, 0, n)
+	require.EqualValues(t, 5, conn.BytesWritten())
+
+	// the same goes for a message read that would cross the limit
+
+	go func() {
+		_, _ = bob.Write([]byte("hello"))
+		_, _ = bob.Write([]byte("world"))
+	}()
+
+	buf := make([]byte, 16)
+
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", buf[:n])
+
+	_, err = conn.Read(buf)
+	require.True(t, errors.Is(err, ErrInjected), err)
+	require.EqualValues(t, 5, conn.BytesRead())
+}
+
+func TestReset(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn, _, closePipe := pipe(Config{ResetProbability: 1})
+	defer closePipe()
+
+	_, err := conn.Write([]byte("hello"))
+	require.True(t, errors.Is(err, ErrInjected), err)
+
+	_, err = conn.Conn.Write([]byte("hello"))
+	require.Error(t, err)
+}
+
+func TestHandshakeStall(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &st.Server{
+		Handshaker: NewHandshaker(st.DefaultServerHandshaker, Config{HandshakeStall: 200 * time.Millisecond}),
+	}
+
+	client := &st.Client{Addr: ln.Addr().String(), HandshakeTimeout: 50 * time.Millisecond}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	_, err = client.Get()
+	require.Error(t, err)
+}
+
+func TestServerWriteFailure(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// The handshake and the reply to the first request fit within 128 bytes, while the reply
+	// to the second request does not.
+
+	server := &st.Server{
+		Handshaker: NewHandshaker(st.DefaultServerHandshaker, Config{FailWriteAfter: 128}),
+		Handler: st.HandlerFunc(func(ctx *st.Context) error {
+			return ctx.Reply(ctx.Body())
+		}),
+	}
+
+	client := &st.Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	_, err = client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+
+	_, err = client.Request(nil, make([]byte, 128))
+	require.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package streaming_transmit
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/lithdew/bytesutil"
+)
+
+// KeyLogLabel prefixes every line written to a key log.
+const KeyLogLabel = "CARLO_SESSION_KEY"
+
+// keyLogMu serializes writes to key logs that are shared between many connections.
+var keyLogMu sync.Mutex
+
+// writeKeyLog records the session key of conn to w in the format
+//
+//	CARLO_SESSION_KEY <client public key> <session key> <local addr> <remote addr>
+//
+// where keys are hex-encoded. The client public key is sent in plaintext at the start of
+// every handshake, which allows for a decoder to tell which session key a captured stream
+// was encrypted with. Connections that do not expose a session key are not logged.
+func writeKeyLog(w io.Writer, conn BufferedConn) error {
+	sc, ok := conn.(interface {
+		ClientPublicKey() []byte
+		SessionKey() []byte
+	})
+	if !ok || sc.SessionKey() == nil {
+		return nil
+	}
+
+	line := fmt.Sprintf("%s %x %x %s %s\n", KeyLogLabel, sc.ClientPublicKey(), sc.SessionKey(),
+		conn.LocalAddr(), conn.RemoteAddr())
+
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+
+	_, err := io.WriteString(w, line)
+	if err != nil {
+		return fmt.Errorf("failed to write key log: %w", err)
+	}
+	return nil
+}
+
+// ParseKeyLog reads a key log, and returns a mapping of hex-encoded client public keys to
+// session keys. Lines that are not key log entries are ignored.
+func ParseKeyLog(r io.Reader) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != KeyLogLabel {
+			continue
+		}
+		key, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("malformed session key for client '%s': %w", fields[1], err)
+		}
+		keys[strings.ToLower(fields[1])] = key
+	}
+
+	return keys, scanner.Err()
+}
+
+// SessionDecoder decrypts messages captured from one direction of a SessionConn, given the
+// session key recorded in a key log.
+type SessionDecoder struct {
+	suite  cipher.AEAD
+	nonce  uint64
+	padded bool
+	buf    []byte
+}
+
+func NewSessionDecoder(key []byte) (*SessionDecoder, error) {
+	suite, err := newSessionSuite(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionDecoder{suite: suite}, nil
+}
+
+// SetPadded sets whether subsequent messages are expected to be padded.
+func (d *SessionDecoder) SetPadded(padded bool) { d.padded = padded }
+
+// Decode decrypts the next message of a stream given its ciphertext, without its length
+// prefix. Messages must be decoded in the order they were captured in.
+func (d *SessionDecoder) Decode(ciphertext []byte) ([]byte, error) {
+	nonce := make([]byte, d.suite.NonceSize())
+	binary.BigEndian.PutUint64(nonce, d.nonce)
+	d.nonce++
+
+	var err error
+	d.buf, err = d.suite.Open(d.buf[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data := d.buf
+	if d.padded {
+		if len(data) < 4 || int(bytesutil.Uint32BE(data[:4])) > len(data)-4 {
+			return nil, fmt.Errorf("malformed padded message: %w", io.ErrUnexpectedEOF)
+		}
+		data = data[4 : 4+bytesutil.Uint32BE(data[:4])]
+	}
+
+	return data, nil
+}
+
+// SplitMessages splits a captured stream into the ciphertexts of length-prefixed messages.
+// Any trailing bytes that do not make up a complete message are returned as leftover.
+func SplitMessages(buf []byte) (messages [][]byte, leftover []byte) {
+	for len(buf) >= 4 {
+		n := bytesutil.Uint32BE(buf[:4])
+		if uint64(len(buf)-4) < uint64(n) {
+			break
+		}
+		messages = append(messages, buf[4:4+n])
+		buf = buf[4+n:]
+	}
+	return messages, buf
+}
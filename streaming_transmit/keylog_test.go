@@ -0,0 +1,116 @@
+package streaming_transmit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+type recordingConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	r, w bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.r.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.w.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func TestKeyLog(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	var (
+		serverLog bytes.Buffer
+		clientLog bytes.Buffer
+		recorded  *recordingConn
+	)
+
+	server := &Server{
+		KeyLog: &serverLog,
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply([]byte("pong"))
+		}),
+	}
+
+	client := &Client{
+		Addr:   ln.Addr().String(),
+		KeyLog: &clientLog,
+		Handshaker: HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+			recorded = &recordingConn{Conn: conn}
+			return DefaultClientHandshaker(recorded)
+		}),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	res, err := client.Request(nil, []byte("ping"))
+	require.NoError(t, err)
+	require.EqualValues(t, "pong", res)
+
+	server.Shutdown()
+	client.Shutdown()
+	require.NoError(t, ln.Close())
+
+	keys, err := ParseKeyLog(&clientLog)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	serverKeys, err := ParseKeyLog(&serverLog)
+	require.NoError(t, err)
+	require.EqualValues(t, keys, serverKeys)
+
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+
+	sent, received := recorded.w.Bytes(), recorded.r.Bytes()
+
+	key, exists := keys[hex.EncodeToString(sent[:32])]
+	require.True(t, exists)
+
+	decode := func(stream []byte) [][]byte {
+		decoder, err := NewSessionDecoder(key)
+		require.NoError(t, err)
+
+		messages, leftover := SplitMessages(stream)
+		require.Len(t, leftover, 0)
+
+		var plaintexts [][]byte
+		for _, message := range messages {
+			plaintext, err := decoder.Decode(message)
+			require.NoError(t, err)
+			plaintexts = append(plaintexts, append([]byte(nil), plaintext...))
+		}
+		return plaintexts
+	}
+
+	requests := decode(sent[32:])
+	require.Len(t, requests, 1)
+	require.EqualValues(t, "ping", requests[0][4:])
+
+	responses := decode(received[32:])
+	require.Len(t, responses, 1)
+	require.EqualValues(t, "pong", responses[0][4:])
+}
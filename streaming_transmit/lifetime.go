@@ -0,0 +1,137 @@
+package streaming_transmit
+
+import (
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+var DefaultMaxConnAgeGrace = 5 * time.Second
+
+// DefaultMaxConnAgeJitter is the fraction by which the maximum age of a connection is randomly
+// lengthened or shortened, such that connections established at the same time are not all
+// recycled at once.
+var DefaultMaxConnAgeJitter = 0.1
+
+var ErrIdleTimeout = errors.New("conn idle for too long")
+var ErrConnRecycled = errors.New("conn recycled")
+
+// jitter randomly lengthens or shortens d by up to DefaultMaxConnAgeJitter of it.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + time.Duration(float64(d)*DefaultMaxConnAgeJitter*(2*rand.Float64()-1))
+}
+
+func (c *Conn) getMaxAgeGrace() time.Duration {
+	if c.MaxAgeGrace <= 0 {
+		return DefaultMaxConnAgeGrace
+	}
+	return c.MaxAgeGrace
+}
+
+// touch records that application traffic was sent or received over the Conn.
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+func (c *Conn) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.active))
+}
+
+// Draining returns true if the Conn is being recycled, either because it reached its maximum
+// age or because its peer asked for it to be. Draining conns are not picked by a Client for
+// new messages, and close once neither side has any pending requests left.
+func (c *Conn) Draining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// recycle starts draining the Conn, and asks the peer to drain it as well.
+func (c *Conn) recycle() {
+	c.mu.Lock()
+	if c.draining {
+		c.mu.Unlock()
+		return
+	}
+	c.draining = true
+	c.mu.Unlock()
+
+	_ = c.sendControl(controlGoAway, 0, "")
+
+	c.checkDrained()
+}
+
+// checkDrained tells the peer once the Conn is draining and has no pending requests left, and
+// closes the Conn once the peer has told the same.
+func (c *Conn) checkDrained() {
+	c.mu.Lock()
+	drained := c.draining && !c.drainedSent && len(c.reqs) == 0
+	if drained {
+		c.drainedSent = true
+	}
+	closed := c.draining && c.drainedSent && c.peerDrained
+	c.mu.Unlock()
+
+	if drained {
+		_ = c.sendControl(controlDrained, 0, "")
+	}
+	if closed {
+		c.Close(ErrConnRecycled)
+	}
+}
+
+// lifetime closes the Conn once it has been idle for IdleTimeout, and recycles it once it has
+// been open for MaxAge. It returns once stop is closed.
+func (c *Conn) lifetime(stop <-chan struct{}) {
+	var idle, age, grace <-chan time.Time
+
+	var idleTimer *time.Timer
+	if c.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(c.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	if c.MaxAge > 0 {
+		timer := time.NewTimer(c.MaxAge)
+		defer timer.Stop()
+		age = timer.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-idle:
+			since := time.Since(c.idleSince())
+			if since >= c.IdleTimeout && c.numPendingRequests() == 0 {
+				c.Close(ErrIdleTimeout)
+				return
+			}
+			if since >= c.IdleTimeout {
+				since = 0
+			}
+			idleTimer.Reset(c.IdleTimeout - since)
+		case <-age:
+			age = nil
+			c.recycle()
+
+			timer := time.NewTimer(c.getMaxAgeGrace())
+			defer timer.Stop()
+			grace = timer.C
+		case <-grace:
+			c.Close(ErrConnRecycled)
+			return
+		}
+	}
+}
+
+func (c *Conn) numPendingRequests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.reqs)
+}
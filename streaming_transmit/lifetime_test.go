@@ -0,0 +1,157 @@
+package streaming_transmit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestServerIdleTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := &Server{
+		IdleTimeout: 100 * time.Millisecond,
+		Handler:     HandlerFunc(func(ctx *Context) error { return ctx.Reply(ctx.Body()) }),
+	}
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	client := &Client{Addr: addr}
+	defer client.Shutdown()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	// Traffic keeps the connection open past its idle timeout.
+
+	for i := 0; i < 10; i++ {
+		_, err := conn.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	require.Len(t, server.Conns(), 1)
+
+	require.Eventually(t, func() bool { return len(server.Conns()) == 0 }, 1*time.Second, 10*time.Millisecond)
+
+	next, err := client.Get()
+	require.NoError(t, err)
+	require.NotEqual(t, conn, next)
+}
+
+func TestServerMaxConnAge(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := &Server{
+		MaxConnAge: 100 * time.Millisecond,
+		Handler: HandlerFunc(func(ctx *Context) error {
+			time.Sleep(150 * time.Millisecond)
+			return ctx.Reply(ctx.Body())
+		}),
+	}
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	client := &Client{Addr: addr}
+	defer client.Shutdown()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	// A request that is pending while the connection is recycled still completes.
+
+	res, err := conn.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	require.Eventually(t, func() bool {
+		next, err := client.Get()
+		return err == nil && next != conn
+	}, 1*time.Second, 10*time.Millisecond)
+
+	require.True(t, conn.Draining())
+}
+
+func TestClientMaxConnAge(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := &Server{}
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	client := &Client{Addr: addr}
+	defer client.Shutdown()
+
+	client.MaxConnAge = 50 * time.Millisecond
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return conn.Draining() }, 1*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return len(server.Conns()) == 0 }, 1*time.Second, 10*time.Millisecond)
+}
+
+func TestConnDrainCanceledRequest(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// The server never replies, such that requests are only ever completed by canceling them.
+
+	server := &Server{Handler: HandlerFunc(func(ctx *Context) error { return nil })}
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	client := &Client{Addr: addr, MaxConnAgeGrace: 5 * time.Second}
+	defer client.Shutdown()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.RequestContext(ctx, nil, []byte("hello"))
+		errs <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return len(conn.reqs) == 1
+	}, 1*time.Second, 10*time.Millisecond)
+
+	conn.recycle()
+
+	require.Eventually(t, func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return conn.peerDrained
+	}, 1*time.Second, 10*time.Millisecond)
+
+	// Canceling the last pending request finishes draining the connection, rather than it
+	// being waited on until the grace period passes.
+
+	cancel()
+	require.Equal(t, context.Canceled, <-errs)
+
+	select {
+	case <-conn.closed:
+	case <-time.After(1 * time.Second):
+		require.Fail(t, "conn was not closed once drained")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		d := jitter(time.Second)
+		require.True(t, d >= 900*time.Millisecond && d <= 1100*time.Millisecond, d)
+	}
+	require.Zero(t, jitter(0))
+}
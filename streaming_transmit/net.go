@@ -34,6 +34,14 @@ func (fn HandlerFunc) HandleMessage(ctx *Context) error { return fn(ctx) }
 
 var DefaultHandler HandlerFunc = func(ctx *Context) error { return nil }
 
+type AcceptFilter interface {
+	Accept(addr net.Addr) bool
+}
+
+type AcceptFilterFunc func(addr net.Addr) bool
+
+func (fn AcceptFilterFunc) Accept(addr net.Addr) bool { return fn(addr) }
+
 type Handshaker interface {
 	Handshake(conn net.Conn) (BufferedConn, error)
 }
@@ -49,7 +57,7 @@ var DefaultClientHandshaker HandshakerFunc = func(conn net.Conn) (BufferedConn,
 		return nil, err
 	}
 
-	return NewSessionConn(session.Suite(), conn), nil
+	return session.NewConn(conn), nil
 }
 
 var DefaultServerHandshaker HandshakerFunc = func(conn net.Conn) (BufferedConn, error) {
@@ -58,5 +66,5 @@ var DefaultServerHandshaker HandshakerFunc = func(conn net.Conn) (BufferedConn,
 	if err != nil {
 		return nil, err
 	}
-	return NewSessionConn(session.Suite(), conn), nil
+	return session.NewConn(conn), nil
 }
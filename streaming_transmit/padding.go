@@ -0,0 +1,184 @@
+package streaming_transmit
+
+import (
+	"fmt"
+
+	"github.com/lithdew/bytesutil"
+)
+
+var DefaultPaddingBlockSize = 256
+
+type PaddingMode uint8
+
+const (
+	PaddingNone PaddingMode = iota
+	PaddingPowerOfTwo
+	PaddingBlock
+	PaddingRandom
+)
+
+const paddingPolicySize = 1 + 4 + 4
+
+// PaddingPolicy decides how much padding is appended to each message a SessionConn writes,
+// such that the size of a message on the wire no longer reveals the exact size of its
+// plaintext.
+type PaddingPolicy struct {
+	Mode PaddingMode
+
+	// Size is the minimum bucket size for PaddingPowerOfTwo, the block size for PaddingBlock,
+	// and the maximum number of padding bytes for PaddingRandom.
+	Size int
+
+	// Max is the maximum size of a padded message on the wire. It should not exceed the read
+	// buffer size of the peer. Messages are never padded beyond it.
+	Max int
+}
+
+func PadPowerOfTwo(min int) PaddingPolicy { return PaddingPolicy{Mode: PaddingPowerOfTwo, Size: min} }
+func PadBlock(size int) PaddingPolicy     { return PaddingPolicy{Mode: PaddingBlock, Size: size} }
+func PadRandom(max int) PaddingPolicy     { return PaddingPolicy{Mode: PaddingRandom, Size: max} }
+
+func (p PaddingPolicy) getMax() int {
+	if p.Max <= 0 {
+		return DefaultReadBufferSize
+	}
+	return p.Max
+}
+
+func (p PaddingPolicy) getBlockSize() int {
+	if p.Size <= 0 {
+		return DefaultPaddingBlockSize
+	}
+	return p.Size
+}
+
+// padding returns the number of padding bytes to append to a message that is n bytes large
+// on the wire.
+func (p PaddingPolicy) padding(n int, random func(int) int) int {
+	size := n
+	switch p.Mode {
+	case PaddingPowerOfTwo:
+		size = 1
+		for size < n || size < p.Size {
+			size <<= 1
+		}
+	case PaddingBlock:
+		block := p.getBlockSize()
+		size = (n + block - 1) / block * block
+	case PaddingRandom:
+		if p.Size > 0 {
+			size = n + random(p.Size+1)
+		}
+	}
+	if max := p.getMax(); size > max {
+		size = max
+	}
+	if size < n {
+		return 0
+	}
+	return size - n
+}
+
+func (p PaddingPolicy) AppendTo(dst []byte) []byte {
+	dst = append(dst, uint8(p.Mode))
+	dst = bytesutil.AppendUint32BE(dst, uint32(p.Size))
+	dst = bytesutil.AppendUint32BE(dst, uint32(p.getMax()))
+	return dst
+}
+
+func UnmarshalPaddingPolicy(buf []byte) (PaddingPolicy, error) {
+	var p PaddingPolicy
+	if len(buf) != paddingPolicySize {
+		return p, fmt.Errorf("padding policy must be %d bytes, got %d bytes", paddingPolicySize, len(buf))
+	}
+	p.Mode = PaddingMode(buf[0])
+	if p.Mode > PaddingRandom {
+		return p, fmt.Errorf("unknown padding mode %d", p.Mode)
+	}
+	p.Size = int(bytesutil.Uint32BE(buf[1:5]))
+	p.Max = int(bytesutil.Uint32BE(buf[5:9]))
+	return p, nil
+}
+
+// NegotiatePadding exchanges padding policies with the peer of a freshly established
+// SessionConn. Both peers must negotiate padding before any other message is exchanged.
+// Messages are padded in both directions if either peer asks for padding: a peer that did
+// not ask for padding adopts the policy of the peer that did.
+func (s *SessionConn) NegotiatePadding(policy PaddingPolicy, client bool) error {
+	buf := make([]byte, paddingPolicySize+s.suite.Overhead())
+
+	var (
+		peer PaddingPolicy
+		err  error
+	)
+
+	write := func() error {
+		_, err := s.Write(policy.AppendTo(nil))
+		if err == nil {
+			err = s.Flush()
+		}
+		return err
+	}
+
+	read := func() error {
+		n, err := s.Read(buf)
+		if err == nil {
+			peer, err = UnmarshalPaddingPolicy(buf[:n])
+		}
+		return err
+	}
+
+	if client {
+		err = write()
+		if err == nil {
+			err = read()
+		}
+	} else {
+		err = read()
+		if err == nil {
+			err = write()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to negotiate padding: %w", err)
+	}
+
+	if policy.Mode == PaddingNone && peer.Mode == PaddingNone {
+		return nil
+	}
+
+	effective := policy
+	if effective.Mode == PaddingNone {
+		effective = peer
+	}
+	effective.Max = policy.getMax()
+	if peer.getMax() < effective.Max {
+		effective.Max = peer.getMax()
+	}
+
+	s.setPadding(effective)
+
+	return nil
+}
+
+// sessionConner is implemented by BufferedConns that are, or are built on top of, a
+// SessionConn, such as the ones established by the default, PSK and certificate handshakers.
+type sessionConner interface {
+	sessionConn() *SessionConn
+}
+
+func (s *SessionConn) sessionConn() *SessionConn { return s }
+
+// negotiatePadding negotiates padding per policy over a conn freshly established by a
+// handshaker. If the maximum size of padded messages is not set, it defaults to readBufferSize,
+// the size of the largest message that may be read from the conn.
+func negotiatePadding(bufConn BufferedConn, policy PaddingPolicy, readBufferSize int, client bool) error {
+	sc, ok := bufConn.(sessionConner)
+	if !ok {
+		return fmt.Errorf("padding requires the handshaker to establish a session, got %T", bufConn)
+	}
+	if policy.Max <= 0 {
+		policy.Max = readBufferSize
+	}
+	return sc.sessionConn().NegotiatePadding(policy, client)
+}
@@ -0,0 +1,151 @@
+package streaming_transmit
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestPaddingPolicy(t *testing.T) {
+	random := func(n int) int { return n - 1 }
+
+	require.EqualValues(t, 64-40, PadPowerOfTwo(0).padding(40, random))
+	require.EqualValues(t, 256-40, PadPowerOfTwo(256).padding(40, random))
+	require.EqualValues(t, 512-300, PadPowerOfTwo(256).padding(300, random))
+	require.EqualValues(t, 0, PadPowerOfTwo(0).padding(64, random))
+
+	require.EqualValues(t, 100-40, PadBlock(100).padding(40, random))
+	require.EqualValues(t, 200-140, PadBlock(100).padding(140, random))
+
+	require.EqualValues(t, 32, PadRandom(32).padding(40, random))
+
+	require.EqualValues(t, DefaultReadBufferSize-3000, PadPowerOfTwo(0).padding(3000, random))
+	require.EqualValues(t, 0, PaddingPolicy{}.padding(40, random))
+
+	actual, err := UnmarshalPaddingPolicy(PadBlock(128).AppendTo(nil))
+	require.NoError(t, err)
+	require.EqualValues(t, PaddingPolicy{Mode: PaddingBlock, Size: 128, Max: DefaultReadBufferSize}, actual)
+}
+
+func TestPaddingSessionConn(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	for _, policy := range []PaddingPolicy{PadPowerOfTwo(64), PadBlock(128), PadRandom(64)} {
+		alice, bob := net.Pipe()
+
+		var (
+			wg      sync.WaitGroup
+			aliceBC BufferedConn
+			err     error
+		)
+
+		// only the client asks for padding, which the server adopts
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			aliceBC, err = DefaultClientHandshaker(alice)
+			if err == nil {
+				err = negotiatePadding(aliceBC, policy, DefaultReadBufferSize, true)
+			}
+		}()
+
+		bobBC, serverErr := DefaultServerHandshaker(bob)
+		if serverErr == nil {
+			serverErr = negotiatePadding(bobBC, PaddingPolicy{}, DefaultReadBufferSize, false)
+		}
+		wg.Wait()
+
+		require.NoError(t, err)
+		require.NoError(t, serverErr)
+
+		aliceConn, bobConn := aliceBC.(*SessionConn), bobBC.(*SessionConn)
+
+		base := bobConn.Stats()
+
+		trials := 128
+
+		go func() {
+			for i := 0; i < trials; i++ {
+				_, err := aliceConn.Write(strconv.AppendUint(nil, uint64(i), 10))
+				require.NoError(t, err)
+			}
+			require.NoError(t, aliceConn.Flush())
+		}()
+
+		buf := make([]byte, 1024)
+
+		for i := 0; i < trials; i++ {
+			n, err := bobConn.Read(buf)
+			require.NoError(t, err)
+			require.EqualValues(t, strconv.AppendUint(nil, uint64(i), 10), buf[:n])
+		}
+
+		sent, received := aliceConn.Stats(), bobConn.Stats()
+
+		require.EqualValues(t, sent.BytesWritten, received.BytesRead)
+		require.EqualValues(t, sent.WireBytesWritten, received.WireBytesRead)
+		require.EqualValues(t, sent.PaddingWritten, received.PaddingRead)
+		require.Greater(t, sent.PaddingWritten, uint64(0))
+
+		if policy.Mode == PaddingPowerOfTwo {
+			require.EqualValues(t, trials*(4+64), received.WireBytesRead-base.WireBytesRead)
+		}
+
+		require.NoError(t, alice.Close())
+		require.NoError(t, bob.Close())
+	}
+}
+
+func TestPaddingWithPSK(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	key := []byte("0123456789abcdef")
+
+	// the server does not ask for padding itself, but caps the size of padded messages to its
+	// read buffer size
+
+	server := &Server{
+		Handshaker:     PSKServerHandshaker(map[string][]byte{"k1": key}),
+		Padding:        &PaddingPolicy{},
+		ReadBufferSize: 2048,
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply(ctx.Body())
+		}),
+	}
+
+	client := &Client{
+		Addr:       ln.Addr().String(),
+		Handshaker: PSKClientHandshaker("k1", key),
+		Padding:    &PaddingPolicy{Mode: PaddingBlock, Size: 1 << 20},
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	sc := conn.BufferedConn().(*PSKSessionConn)
+	base := sc.Stats()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	require.EqualValues(t, 4+2048, sc.Stats().WireBytesWritten-base.WireBytesWritten)
+}
@@ -9,6 +9,8 @@ type pendingRequest struct {
 	dst []byte         // dst to copy response to
 	err error          // error while waiting for response
 	wg  sync.WaitGroup // signals the caller that the response has been received
+
+	trace *ClientTrace // notified once the response is received
 }
 
 type PendingRequestPool struct {
@@ -32,6 +34,7 @@ func (p *PendingRequestPool) acquire(dst []byte) *pendingRequest {
 func (p *PendingRequestPool) release(pr *pendingRequest) {
 	pr.dst = nil
 	pr.err = nil
+	pr.trace = nil
 	p.sp.Put(pr)
 	atomic.AddUint32(&p.m.np, uint32(1))
 }
@@ -12,6 +12,9 @@ type pendingWrite struct {
 	wait bool                       // signal to caller if they're waiting
 	err  error                      // keeps track of any socket errors on write
 	wg   sync.WaitGroup             // signals the caller that this write is complete
+
+	seq   uint32       // sequence number of the payload
+	trace *ClientTrace // notified once the write is flushed
 }
 
 type PendingWritePool struct {
@@ -36,6 +39,7 @@ func (p *PendingWritePool) acquire(buf *bytebufferpool.ByteBuffer, wait bool) *p
 
 func (p *PendingWritePool) release(pw *pendingWrite) {
 	pw.err = nil
+	pw.trace = nil
 	p.sp.Put(pw)
 	atomic.AddUint32(&p.m.np, uint32(1))
 }
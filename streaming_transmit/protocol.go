@@ -0,0 +1,154 @@
+package streaming_transmit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lithdew/bytesutil"
+)
+
+var ErrNoCommonProtocol = errors.New("no application protocol in common with peer")
+
+// maxProtocolMessageSize bounds the size of messages exchanged while negotiating protocols,
+// which leaves room for a full list of protocols along with any padding or framing overhead.
+const maxProtocolMessageSize = 1 << 16
+
+// negotiateProtocol is run by a Client over a freshly established connection. It offers the
+// protocols the client supports in order of preference, and returns the one the server picked.
+func negotiateProtocol(conn BufferedConn, protocols []string) (string, error) {
+	if len(protocols) > 255 {
+		return "", fmt.Errorf("cannot offer more than 255 protocols, got %d", len(protocols))
+	}
+
+	offer := []byte{byte(len(protocols))}
+	for _, protocol := range protocols {
+		if len(protocol) == 0 || len(protocol) > 255 {
+			return "", fmt.Errorf("protocol name '%s' must be 1 to 255 bytes", protocol)
+		}
+		offer = append(offer, byte(len(protocol)))
+		offer = append(offer, protocol...)
+	}
+
+	err := writeProtocolMessage(conn, appendControlFrame(nil, controlProtocol, offer))
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, maxProtocolMessageSize)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to read negotiated protocol: %w", err)
+	}
+
+	picked, ok := parseControlFrame(buf[:n], controlProtocol)
+	if !ok {
+		return "", fmt.Errorf("server did not respond to the offered protocols: %w", ErrNoCommonProtocol)
+	}
+	if len(picked) < 1 || int(picked[0]) != len(picked)-1 {
+		return "", fmt.Errorf("malformed negotiated protocol: %w", io.ErrUnexpectedEOF)
+	}
+	if len(picked) == 1 {
+		return "", ErrNoCommonProtocol
+	}
+
+	protocol := string(picked[1:])
+	for _, offered := range protocols {
+		if offered == protocol {
+			return protocol, nil
+		}
+	}
+
+	return "", fmt.Errorf("server picked protocol '%s' which was not offered", protocol)
+}
+
+// acceptProtocol is run by a Server over a freshly established connection. It picks the first
+// of the protocols offered by the client that handlers has a Handler for.
+func acceptProtocol(conn BufferedConn, handlers map[string]Handler) (string, Handler, error) {
+	buf := make([]byte, maxProtocolMessageSize)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read offered protocols: %w", err)
+	}
+
+	// a client that does not negotiate protocols is told why its connection is being closed,
+	// such that its pending requests fail with ErrNoCommonProtocol
+
+	offer, ok := parseControlFrame(buf[:n], controlProtocol)
+	if !ok {
+		_ = writeProtocolMessage(conn, appendControlFrame(nil, controlClose, []byte(ErrNoCommonProtocol.Error())))
+		return "", nil, fmt.Errorf("client did not offer any protocols: %w", ErrNoCommonProtocol)
+	}
+	if len(offer) < 1 {
+		return "", nil, fmt.Errorf("malformed offered protocols: %w", io.ErrUnexpectedEOF)
+	}
+
+	count := int(offer[0])
+	offer = offer[1:]
+
+	var (
+		protocol string
+		handler  Handler
+	)
+
+	for i := 0; i < count; i++ {
+		if len(offer) < 1 || len(offer) < 1+int(offer[0]) {
+			return "", nil, fmt.Errorf("malformed offered protocols: %w", io.ErrUnexpectedEOF)
+		}
+		name := string(offer[1 : 1+offer[0]])
+		offer = offer[1+offer[0]:]
+
+		if h, exists := handlers[name]; exists && handler == nil {
+			protocol, handler = name, h
+		}
+	}
+
+	err = writeProtocolMessage(conn, appendControlFrame(nil, controlProtocol, append([]byte{byte(len(protocol))}, protocol...)))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if handler == nil {
+		return "", nil, ErrNoCommonProtocol
+	}
+
+	return protocol, handler, nil
+}
+
+// appendControlFrame appends a control frame of the given kind. Protocols are negotiated with
+// control frames before a Conn is set up, such that a peer that is not configured to negotiate
+// protocols tells them apart from application messages.
+func appendControlFrame(dst []byte, kind byte, message []byte) []byte {
+	dst = bytesutil.AppendUint32BE(dst, controlSeq)
+	dst = append(dst, kind)
+	dst = bytesutil.AppendUint32BE(dst, 0)
+	dst = append(dst, message...)
+	return dst
+}
+
+// parseControlFrame returns the message of buf if it is a control frame of the given kind.
+func parseControlFrame(buf []byte, kind byte) ([]byte, bool) {
+	if len(buf) < 9 || bytesutil.Uint32BE(buf[:4]) != controlSeq || buf[4] != kind {
+		return nil, false
+	}
+	return buf[9:], true
+}
+
+func writeProtocolMessage(conn BufferedConn, buf []byte) error {
+	_, err := conn.Write(buf)
+	if err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write protocol negotiation: %w", err)
+	}
+	return nil
+}
+
+// Protocol returns the application protocol negotiated while establishing the Conn, or an
+// empty string if no protocol was negotiated.
+func (c *Conn) Protocol() string {
+	return c.protocol
+}
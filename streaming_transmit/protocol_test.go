@@ -0,0 +1,117 @@
+package streaming_transmit
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestServerProtocols(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	reply := func(prefix string) Handler {
+		return HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply([]byte(prefix + ctx.Conn().Protocol()))
+		})
+	}
+
+	server := &Server{
+		Protocols: map[string]Handler{
+			"rpc/1": reply("rpc: "),
+			"raw":   reply("raw: "),
+		},
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	clients := []*Client{
+		{Addr: ln.Addr().String(), Protocols: []string{"rpc/2", "rpc/1", "raw"}},
+		{Addr: ln.Addr().String(), Protocols: []string{"raw"}},
+		{Addr: ln.Addr().String(), Protocols: []string{"unknown"}},
+	}
+
+	defer func() {
+		server.Shutdown()
+		for _, client := range clients {
+			client.Shutdown()
+		}
+		require.NoError(t, ln.Close())
+	}()
+
+	conn, err := clients[0].Get()
+	require.NoError(t, err)
+	require.Equal(t, "rpc/1", conn.Protocol())
+
+	res, err := clients[0].Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "rpc: rpc/1", res)
+
+	res, err = clients[1].Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "raw: raw", res)
+
+	_, err = clients[2].Get()
+	require.True(t, errors.Is(err, ErrNoCommonProtocol), err)
+}
+
+func TestProtocolsMismatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	negotiating, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	echo := HandlerFunc(func(ctx *Context) error {
+		return ctx.Reply(ctx.Body())
+	})
+
+	server := &Server{Handler: echo}
+	negotiatingServer := &Server{Protocols: map[string]Handler{"raw": echo}}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	go func() {
+		require.NoError(t, negotiatingServer.Serve(negotiating))
+	}()
+
+	// a client offering protocols to a server that does not negotiate any fails right away,
+	// rather than once its handshake times out
+
+	client := &Client{Addr: ln.Addr().String(), Protocols: []string{"raw"}, HandshakeTimeout: 5 * time.Second}
+
+	// a client that does not offer protocols to a server that requires them has its first
+	// request fail, rather than having it be mistaken for an offer
+
+	plainClient := &Client{Addr: negotiating.Addr().String()}
+
+	defer func() {
+		server.Shutdown()
+		negotiatingServer.Shutdown()
+		client.Shutdown()
+		plainClient.Shutdown()
+		require.NoError(t, ln.Close())
+		require.NoError(t, negotiating.Close())
+	}()
+
+	start := time.Now()
+	_, err = client.Get()
+	require.True(t, errors.Is(err, ErrNoCommonProtocol), err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	_, err = plainClient.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrConnClosedByPeer), err)
+	require.Contains(t, err.Error(), ErrNoCommonProtocol.Error())
+}
@@ -0,0 +1,181 @@
+package streaming_transmit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/lithdew/bytesutil"
+)
+
+var ErrMalformedProxyHeader = errors.New("malformed proxy protocol header")
+
+const maxProxyHeaderV1Size = 107
+
+var proxyHeaderV1Prefix = []byte("PROXY")
+var proxyHeaderV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a net.Conn whose addresses were taken from a PROXY protocol header sent by
+// a trusted load balancer in front of a Server.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header off of conn. It returns a net.Conn
+// that reports the addresses carried by the header. Headers that do not carry addresses,
+// such as health checks sent by load balancers, leave the addresses of conn untouched.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	pc := &proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		local:  conn.LocalAddr(),
+		remote: conn.RemoteAddr(),
+	}
+
+	prefix, err := pc.r.Peek(len(proxyHeaderV1Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy protocol header: %w", err)
+	}
+
+	if bytes.Equal(prefix, proxyHeaderV1Prefix) {
+		err = pc.readHeaderV1()
+	} else {
+		err = pc.readHeaderV2()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+func (c *proxyConn) readHeaderV1() error {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("failed to read proxy protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxProxyHeaderV1Size {
+			return fmt.Errorf("%w: v1 header exceeds %d bytes", ErrMalformedProxyHeader, maxProxyHeaderV1Size)
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("%w: v1 header does not end with crlf", ErrMalformedProxyHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return fmt.Errorf("%w: v1 header is missing its protocol", ErrMalformedProxyHeader)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("%w: unknown v1 protocol '%s'", ErrMalformedProxyHeader, fields[1])
+	}
+
+	if len(fields) != 6 {
+		return fmt.Errorf("%w: v1 header has %d field(s)", ErrMalformedProxyHeader, len(fields))
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || srcErr != nil || dstErr != nil {
+		return fmt.Errorf("%w: v1 header has malformed addresses", ErrMalformedProxyHeader)
+	}
+
+	c.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+
+	return nil
+}
+
+func (c *proxyConn) readHeaderV2() error {
+	header := make([]byte, len(proxyHeaderV2Signature)+4)
+	_, err := io.ReadFull(c.r, header)
+	if err != nil {
+		return fmt.Errorf("failed to read proxy protocol v2 header: %w", err)
+	}
+	if !bytes.Equal(header[:len(proxyHeaderV2Signature)], proxyHeaderV2Signature) {
+		return fmt.Errorf("%w: missing header", ErrMalformedProxyHeader)
+	}
+	header = header[len(proxyHeaderV2Signature):]
+
+	version, command, family := header[0]>>4, header[0]&0x0f, header[1]
+	if version != 2 {
+		return fmt.Errorf("%w: unknown version %d", ErrMalformedProxyHeader, version)
+	}
+
+	body := make([]byte, bytesutil.Uint16BE(header[2:4]))
+	_, err = io.ReadFull(c.r, body)
+	if err != nil {
+		return fmt.Errorf("failed to read proxy protocol v2 addresses: %w", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("%w: unknown v2 command %d", ErrMalformedProxyHeader, command)
+	}
+
+	var size int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC and AF_UNIX carry no ip addresses
+		return nil
+	}
+
+	if len(body) < 2*size+4 {
+		return fmt.Errorf("%w: v2 addresses are truncated", ErrMalformedProxyHeader)
+	}
+
+	src := net.IP(append([]byte(nil), body[:size]...))
+	dst := net.IP(append([]byte(nil), body[size:2*size]...))
+	srcPort, dstPort := bytesutil.Uint16BE(body[2*size:2*size+2]), bytesutil.Uint16BE(body[2*size+2:2*size+4])
+
+	if family&0x0f == 0x2 { // DGRAM
+		c.remote = &net.UDPAddr{IP: src, Port: int(srcPort)}
+		c.local = &net.UDPAddr{IP: dst, Port: int(dstPort)}
+	} else {
+		c.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+		c.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	}
+
+	return nil
+}
+
+// isTrustedProxy returns true if a PROXY protocol header is expected to be sent by the peer
+// at addr.
+func (s *Server) isTrustedProxy(addr net.Addr) bool {
+	if !s.ProxyProtocol {
+		return false
+	}
+	ip := remoteIP(addr)
+	return ip != nil && containsIP(s.TrustedProxies, ip)
+}
@@ -0,0 +1,150 @@
+package streaming_transmit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/lithdew/bytesutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func proxyHeaderV2(command, family byte, addrs []byte) []byte {
+	header := append([]byte(nil), proxyHeaderV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = bytesutil.AppendUint16BE(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ipv6 := net.ParseIP("2001:db8::1")
+
+	v2addrs := append(append(append([]byte(nil), ipv6...), net.IPv6loopback...), 0x1f, 0x90, 0x00, 0x50)
+
+	tests := []struct {
+		header []byte
+		remote string
+		local  string
+		err    error
+	}{
+		{header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), remote: "192.0.2.1:56324", local: "198.51.100.1:443"},
+		{header: []byte("PROXY TCP6 2001:db8::1 ::1 8080 80\r\n"), remote: "[2001:db8::1]:8080", local: "[::1]:80"},
+		{header: []byte("PROXY UNKNOWN\r\n"), remote: "pipe", local: "pipe"},
+		{header: proxyHeaderV2(0x1, 0x21, v2addrs), remote: "[2001:db8::1]:8080", local: "[::1]:80"},
+		{header: proxyHeaderV2(0x1, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}), remote: "192.0.2.1:56324", local: "198.51.100.1:443"},
+		{header: proxyHeaderV2(0x0, 0x00, nil), remote: "pipe", local: "pipe"},
+		{header: []byte("PROXY TCP4 192.0.2.1 56324 443\r\n"), err: ErrMalformedProxyHeader},
+		{header: []byte("not a proxy protocol header!"), err: ErrMalformedProxyHeader},
+	}
+
+	for _, test := range tests {
+		alice, bob := net.Pipe()
+
+		go func() {
+			_, _ = alice.Write(append(test.header, "payload"...))
+		}()
+
+		conn, err := readProxyHeader(bob)
+		if test.err != nil {
+			require.True(t, errors.Is(err, test.err), "%q: %v", test.header, err)
+		} else {
+			require.NoError(t, err, "%q", test.header)
+			require.Equal(t, test.remote, conn.RemoteAddr().String())
+			require.Equal(t, test.local, conn.LocalAddr().String())
+
+			buf := make([]byte, len("payload"))
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			require.EqualValues(t, "payload", buf)
+		}
+
+		require.NoError(t, alice.Close())
+		require.NoError(t, bob.Close())
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	trusted, err := ParseCIDRs("127.0.0.0/8")
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &Server{
+		ProxyProtocol:  true,
+		TrustedProxies: trusted,
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply([]byte(ctx.Conn().RemoteAddr().String()))
+		}),
+	}
+
+	client := &Client{
+		Addr: ln.Addr().String(),
+		Handshaker: HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+			err := Write(conn, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+			if err != nil {
+				return nil, err
+			}
+			return DefaultClientHandshaker(conn)
+		}),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	res, err := client.Request(nil, []byte("where am i?"))
+	require.NoError(t, err)
+	require.EqualValues(t, "192.0.2.1:56324", res)
+}
+
+func TestServerProxyProtocolUntrusted(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	trusted, err := ParseCIDRs("10.0.0.0/8")
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &Server{
+		ProxyProtocol:  true,
+		TrustedProxies: trusted,
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply([]byte(ctx.Conn().RemoteAddr().String()))
+		}),
+	}
+
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	res, err := client.Request(nil, []byte("where am i?"))
+	require.NoError(t, err)
+	require.EqualValues(t, conn.LocalAddr().String(), res)
+}
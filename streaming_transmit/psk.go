@@ -0,0 +1,176 @@
+package streaming_transmit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+const (
+	MinPSKSize = 16
+	MaxPSKSize = 64
+)
+
+var (
+	ErrUnknownPSK  = errors.New("unknown pre-shared key id")
+	ErrPSKMismatch = errors.New("pre-shared key mismatch")
+)
+
+var (
+	pskClientConfirm = []byte("carlo psk client confirm")
+	pskServerConfirm = []byte("carlo psk server confirm")
+)
+
+var _ BufferedConn = (*PSKSessionConn)(nil)
+
+// PSKSessionConn is a SessionConn whose session key was derived with a pre-shared key. It
+// records the id of the pre-shared key the peer authenticated with.
+type PSKSessionConn struct {
+	*SessionConn
+	keyID string
+}
+
+// KeyID returns the id of the pre-shared key that was used to establish the session.
+func (c *PSKSessionConn) KeyID() string { return c.keyID }
+
+// PSKClientHandshaker returns a Handshaker that establishes a session with a server that
+// holds the pre-shared key registered under keyID.
+func PSKClientHandshaker(keyID string, key []byte) HandshakerFunc {
+	return func(conn net.Conn) (BufferedConn, error) {
+		var session Session
+		err := session.DoClientWithPSK(conn, keyID, key)
+		if err != nil {
+			return nil, err
+		}
+
+		sc := session.NewConn(conn)
+
+		err = writePSKConfirm(sc, pskClientConfirm)
+		if err == nil {
+			err = readPSKConfirm(sc, pskServerConfirm)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &PSKSessionConn{SessionConn: sc, keyID: keyID}, nil
+	}
+}
+
+// PSKServerHandshaker returns a Handshaker that only establishes sessions with clients that
+// present one of the given pre-shared keys. Keys are keyed by their ids; listing both an old
+// and a new key allows for clients to be rotated over to the new key one by one.
+func PSKServerHandshaker(keys map[string][]byte) HandshakerFunc {
+	return func(conn net.Conn) (BufferedConn, error) {
+		var session Session
+		keyID, err := session.DoServerWithPSK(conn, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		sc := session.NewConn(conn)
+
+		err = readPSKConfirm(sc, pskClientConfirm)
+		if err == nil {
+			err = writePSKConfirm(sc, pskServerConfirm)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &PSKSessionConn{SessionConn: sc, keyID: keyID}, nil
+	}
+}
+
+// DoClientWithPSK performs a client-side handshake, announcing keyID to the server and
+// mixing key into the derived session key.
+func (s *Session) DoClientWithPSK(conn net.Conn, keyID string, key []byte) error {
+	if len(keyID) > math.MaxUint8 {
+		return fmt.Errorf("pre-shared key id is too large - must be <= %d bytes", math.MaxUint8)
+	}
+
+	ourPub, ourPriv, err := s.GenerateEphemeralKeys()
+	if err != nil {
+		return err
+	}
+
+	hello := make([]byte, 0, 1+len(keyID)+len(ourPub))
+	hello = append(hello, uint8(len(keyID)))
+	hello = append(hello, keyID...)
+	hello = append(hello, ourPub...)
+
+	err = Write(conn, hello)
+	if err != nil {
+		return fmt.Errorf("failed to write psk session hello: %w", err)
+	}
+	s.ourPub = ourPub
+	s.clientPub = ourPub
+
+	err = s.Read(conn)
+	if err == nil {
+		err = s.EstablishWithPSK(ourPriv, key)
+	}
+	return err
+}
+
+// DoServerWithPSK performs a server-side handshake, looking up the pre-shared key announced
+// by the client in keys. It returns the id of the key the client announced.
+func (s *Session) DoServerWithPSK(conn net.Conn, keys map[string][]byte) (string, error) {
+	ourPub, ourPriv, err := s.GenerateEphemeralKeys()
+	if err != nil {
+		return "", err
+	}
+
+	size, err := Read(make([]byte, 1), conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read psk id length: %w", err)
+	}
+	id, err := Read(make([]byte, size[0]), conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read psk id: %w", err)
+	}
+	keyID := string(id)
+
+	key, exists := keys[keyID]
+	if !exists {
+		return keyID, fmt.Errorf("%w: '%s'", ErrUnknownPSK, keyID)
+	}
+
+	err = s.Read(conn)
+	if err == nil {
+		err = s.Write(conn, ourPub)
+	}
+	if err == nil {
+		err = s.EstablishWithPSK(ourPriv, key)
+	}
+	s.clientPub = s.theirPub
+	return keyID, err
+}
+
+func writePSKConfirm(sc *SessionConn, label []byte) error {
+	_, err := sc.Write(label)
+	if err == nil {
+		err = sc.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write psk confirmation: %w", err)
+	}
+	return nil
+}
+
+func readPSKConfirm(sc *SessionConn, label []byte) error {
+	// the confirmation is read sealed, and is thus larger than label by the overhead of the
+	// aead suite
+
+	buf := make([]byte, len(label)+sc.suite.Overhead())
+	n, err := sc.Read(buf)
+	if err != nil {
+		return fmt.Errorf("%w: failed to read psk confirmation: %s", ErrPSKMismatch, err)
+	}
+	if !bytes.Equal(buf[:n], label) {
+		return fmt.Errorf("%w: unexpected psk confirmation", ErrPSKMismatch)
+	}
+	return nil
+}
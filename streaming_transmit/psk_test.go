@@ -0,0 +1,140 @@
+package streaming_transmit
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestPSKHandshake(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	keys := map[string][]byte{"old": oldKey, "new": newKey}
+
+	for _, keyID := range []string{"old", "new"} {
+		alice, bob := net.Pipe()
+
+		var (
+			wg      sync.WaitGroup
+			aliceBC BufferedConn
+			bobBC   BufferedConn
+			err     error
+		)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			aliceBC, err = PSKClientHandshaker(keyID, keys[keyID])(alice)
+		}()
+
+		bobBC, serverErr := PSKServerHandshaker(keys)(bob)
+		wg.Wait()
+
+		require.NoError(t, err)
+		require.NoError(t, serverErr)
+
+		require.Equal(t, keyID, aliceBC.(*PSKSessionConn).KeyID())
+		require.Equal(t, keyID, bobBC.(*PSKSessionConn).KeyID())
+
+		require.NoError(t, alice.Close())
+		require.NoError(t, bob.Close())
+	}
+}
+
+func TestPSKHandshakeMismatch(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+	defer func() {
+		require.NoError(t, alice.Close())
+		require.NoError(t, bob.Close())
+	}()
+
+	var (
+		wg  sync.WaitGroup
+		err error
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err = PSKClientHandshaker("k", bytes.Repeat([]byte{1}, 32))(alice)
+		alice.Close()
+	}()
+
+	_, serverErr := PSKServerHandshaker(map[string][]byte{"k": bytes.Repeat([]byte{2}, 32)})(bob)
+	bob.Close()
+	wg.Wait()
+
+	require.True(t, errors.Is(serverErr, ErrPSKMismatch))
+	require.Error(t, err)
+}
+
+func TestPSKHandshakeUnknownKeyID(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+	defer func() {
+		require.NoError(t, alice.Close())
+		require.NoError(t, bob.Close())
+	}()
+
+	var (
+		wg  sync.WaitGroup
+		err error
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err = PSKClientHandshaker("unknown", bytes.Repeat([]byte{1}, 32))(alice)
+	}()
+
+	_, serverErr := PSKServerHandshaker(map[string][]byte{"k": bytes.Repeat([]byte{1}, 32)})(bob)
+	bob.Close()
+	wg.Wait()
+
+	require.True(t, errors.Is(serverErr, ErrUnknownPSK))
+	require.Error(t, err)
+}
+
+func TestPSKClientServer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	key := bytes.Repeat([]byte{3}, 32)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{
+		Handshaker: PSKServerHandshaker(map[string][]byte{"cluster": key}),
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply([]byte(ctx.Conn().BufferedConn().(*PSKSessionConn).KeyID()))
+		}),
+	}
+
+	client := &Client{Addr: ln.Addr().String(), Handshaker: PSKClientHandshaker("cluster", key)}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	res, err := client.Request(nil, []byte("which key?"))
+	require.NoError(t, err)
+	require.EqualValues(t, "cluster", res)
+}
@@ -0,0 +1,255 @@
+package streaming_transmit
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RateLimitPolicy int
+
+const (
+	// RateLimitDelay stops reading from a connection until its limits allow for the next
+	// message to be handled, which applies backpressure to the peer through TCP.
+	RateLimitDelay RateLimitPolicy = iota
+
+	// RateLimitReject drops messages that exceed the limits. Requests that are dropped fail
+	// with ErrRequestRejected on the side of the peer.
+	RateLimitReject
+)
+
+// RateLimit configures token bucket limits on the messages handled from a connection or peer.
+// Limits that are zero are disabled.
+type RateLimit struct {
+	MessagesPerSecond float64
+	MessageBurst      int
+
+	BytesPerSecond float64
+	ByteBurst      int
+
+	Policy RateLimitPolicy
+}
+
+func (l RateLimit) enabled() bool {
+	return l.MessagesPerSecond > 0 || l.BytesPerSecond > 0
+}
+
+// ConnStats are counters of the messages read by a Conn, and of how many of them were delayed
+// or rejected by rate limits.
+type ConnStats struct {
+	MessagesRead    uint64
+	BytesRead       uint64
+	MessagesDelayed uint64        // messages that were delayed
+	ThrottledTime   time.Duration // total time spent delaying messages
+	Rejected        uint64        // messages that were rejected
+}
+
+// rateLimiter enforces a RateLimit. It may be shared by several connections of a peer.
+type rateLimiter struct {
+	mu       sync.Mutex
+	policy   RateLimitPolicy
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newRateLimiter(l RateLimit, now time.Time) *rateLimiter {
+	if !l.enabled() {
+		return nil
+	}
+
+	rl := &rateLimiter{policy: l.Policy}
+	if l.MessagesPerSecond > 0 {
+		rl.messages = newTokenBucket(l.MessagesPerSecond, l.MessageBurst, now)
+	}
+	if l.BytesPerSecond > 0 {
+		rl.bytes = newTokenBucket(l.BytesPerSecond, l.ByteBurst, now)
+	}
+	return rl
+}
+
+// allow takes the tokens needed to handle a message of the given size out of all buckets if
+// every bucket holds enough of them. Messages larger than the byte burst are allowed through
+// once the byte bucket is full, rather than never.
+func (l *rateLimiter) allow(size int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := float64(size)
+
+	if l.messages != nil {
+		l.messages.refill(now)
+		if l.messages.tokens < 1 {
+			return false
+		}
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		if l.bytes.tokens < math.Min(n, l.bytes.burst) {
+			return false
+		}
+	}
+
+	if l.messages != nil {
+		l.messages.tokens--
+	}
+	if l.bytes != nil {
+		l.bytes.tokens -= n
+	}
+	return true
+}
+
+// reserve takes the tokens needed to handle a message of the given size out of all buckets,
+// and returns how long to wait until the buckets are out of debt.
+func (l *rateLimiter) reserve(size int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var delay time.Duration
+	if l.messages != nil {
+		delay = l.messages.borrow(1, now)
+	}
+	if l.bytes != nil {
+		if d := l.bytes.borrow(float64(size), now); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// borrow takes n tokens out of the bucket, going into debt if it holds less than n tokens,
+// and returns how long it takes for the debt to be paid off. It must be called with the lock
+// of the rateLimiter owning the bucket held.
+func (b *tokenBucket) borrow(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// peerLimiter is a rateLimiter shared by all connections of a peer.
+type peerLimiter struct {
+	conns   int
+	limiter *rateLimiter
+}
+
+// peerIdentity identifies the peer of conn for the sake of rate limiting. Peers are identified
+// by their certificate subject if they authenticated with one, and by their remote IP otherwise.
+// As pre-shared keys are shared by whole clusters, peers that authenticated with one are told
+// apart by their remote IP along with the ID of their key.
+func peerIdentity(conn *Conn) string {
+	if cert := conn.PeerCertificate(); cert != nil {
+		return "cert:" + cert.Subject
+	}
+
+	addr := "addr:" + conn.RemoteAddr().String()
+	if ip := remoteIP(conn.RemoteAddr()); ip != nil {
+		addr = "ip:" + ip.String()
+	}
+
+	if bc, ok := conn.BufferedConn().(interface{ KeyID() string }); ok {
+		return "psk:" + bc.KeyID() + "," + addr
+	}
+	return addr
+}
+
+// acquireLimiters returns the rate limiters conn is subject to. The returned release func must
+// be called once conn is closed.
+func (s *Server) acquireLimiters(conn *Conn) ([]*rateLimiter, func()) {
+	now := time.Now()
+
+	var limiters []*rateLimiter
+	if rl := newRateLimiter(s.ConnRateLimit, now); rl != nil {
+		limiters = append(limiters, rl)
+	}
+
+	if !s.PeerRateLimit.enabled() {
+		return limiters, func() {}
+	}
+
+	key := peerIdentity(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, exists := s.limiters[key]
+	if !exists {
+		peer = &peerLimiter{limiter: newRateLimiter(s.PeerRateLimit, now)}
+		s.limiters[key] = peer
+	}
+	peer.conns++
+
+	return append(limiters, peer.limiter), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		peer.conns--
+		if peer.conns == 0 {
+			delete(s.limiters, key)
+		}
+	}
+}
+
+// Stats returns counters of the messages read by the Conn.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		MessagesRead:    atomic.LoadUint64(&c.stats.MessagesRead),
+		BytesRead:       atomic.LoadUint64(&c.stats.BytesRead),
+		MessagesDelayed: atomic.LoadUint64(&c.stats.MessagesDelayed),
+		ThrottledTime:   time.Duration(atomic.LoadInt64((*int64)(&c.stats.ThrottledTime))),
+		Rejected:        atomic.LoadUint64(&c.stats.Rejected),
+	}
+}
+
+// throttle applies the rate limits of the Conn to a message of the given size that was sent
+// with seq. It reports false if the message is to be dropped, either because it was rejected
+// or because stop was closed while it was being delayed.
+func (c *Conn) throttle(seq uint32, size int, stop <-chan struct{}) bool {
+	atomic.AddUint64(&c.stats.MessagesRead, 1)
+	atomic.AddUint64(&c.stats.BytesRead, uint64(size))
+
+	if len(c.limiters) == 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	for _, l := range c.limiters {
+		if l.policy == RateLimitReject && !l.allow(size, now) {
+			atomic.AddUint64(&c.stats.Rejected, 1)
+			if seq != 0 {
+				_ = c.reject(seq, "rate limited")
+			}
+			return false
+		}
+	}
+
+	var delay time.Duration
+	for _, l := range c.limiters {
+		if l.policy != RateLimitDelay {
+			continue
+		}
+		if d := l.reserve(size, now); d > delay {
+			delay = d
+		}
+	}
+
+	if delay <= 0 {
+		return true
+	}
+
+	atomic.AddUint64(&c.stats.MessagesDelayed, 1)
+	atomic.AddInt64((*int64)(&c.stats.ThrottledTime), int64(delay))
+
+	timer := timerPool.acquire(delay)
+	defer timerPool.release(timer)
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,190 @@
+package streaming_transmit
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// echoConns makes server echo requests, and returns a func returning the connections it
+// accepted in the order they were accepted.
+func echoConns(server *Server) func() *Conn {
+	conns := make(chan *Conn, 16)
+
+	server.Handler = HandlerFunc(func(ctx *Context) error { return ctx.Reply(ctx.Body()) })
+	server.ConnState = ConnStateHandlerFunc(func(conn *Conn, state ConnState) {
+		if state == StateNew {
+			conns <- conn
+		}
+	})
+
+	return func() *Conn { return <-conns }
+}
+
+func TestConnRateLimitReject(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := &Server{
+		ConnRateLimit: RateLimit{MessagesPerSecond: 0.001, MessageBurst: 2, Policy: RateLimitReject},
+	}
+	accepted := echoConns(server)
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	client := &Client{Addr: addr}
+	defer client.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+	}
+
+	_, err := client.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrRequestRejected), err)
+
+	stats := accepted().Stats()
+	require.EqualValues(t, 3, stats.MessagesRead)
+	require.EqualValues(t, 15, stats.BytesRead)
+	require.EqualValues(t, 1, stats.Rejected)
+}
+
+func TestConnRateLimitDelay(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := &Server{
+		ConnRateLimit: RateLimit{BytesPerSecond: 100, ByteBurst: 10},
+	}
+	accepted := echoConns(server)
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	client := &Client{Addr: addr}
+	defer client.Shutdown()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+	}
+	_, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+
+	require.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	stats := accepted().Stats()
+	require.EqualValues(t, 4, stats.MessagesRead)
+	require.EqualValues(t, 2, stats.MessagesDelayed)
+	require.True(t, stats.ThrottledTime > 0)
+	require.Zero(t, stats.Rejected)
+}
+
+func TestPeerRateLimit(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := &Server{
+		PeerRateLimit: RateLimit{MessagesPerSecond: 0.001, MessageBurst: 2, Policy: RateLimitReject},
+	}
+	echoConns(server)
+
+	addr, stop := serveTest(t, server)
+	defer stop()
+
+	a := &Client{Addr: addr}
+	defer a.Shutdown()
+
+	b := &Client{Addr: addr}
+	defer b.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		_, err := a.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+	}
+
+	_, err := b.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrRequestRejected), err)
+}
+
+// remoteIPListener makes every connection it accepts appear to come from a different IP.
+type remoteIPListener struct {
+	net.Listener
+	accepted uint32
+}
+
+func (ln *remoteIPListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddUint32(&ln.accepted, 1)
+	return remoteIPConn{Conn: conn, addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(n)), Port: 1234}}, nil
+}
+
+type remoteIPConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteIPConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestPeerRateLimitPSK(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	keys := map[string][]byte{"cluster": bytes.Repeat([]byte{1}, 32)}
+
+	server := &Server{
+		Handshaker:    PSKServerHandshaker(keys),
+		PeerRateLimit: RateLimit{MessagesPerSecond: 0.001, MessageBurst: 2, Policy: RateLimitReject},
+	}
+	echoConns(server)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, server.Serve(&remoteIPListener{Listener: ln}))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// peers sharing the key of their cluster are each given a budget of their own
+
+	a := &Client{Addr: ln.Addr().String(), Handshaker: PSKClientHandshaker("cluster", keys["cluster"])}
+	defer a.Shutdown()
+
+	b := &Client{Addr: ln.Addr().String(), Handshaker: PSKClientHandshaker("cluster", keys["cluster"])}
+	defer b.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		_, err := a.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+	}
+
+	_, err = a.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrRequestRejected), err)
+
+	for i := 0; i < 2; i++ {
+		_, err := b.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+	}
+}
+
+func TestConnNextSkipsControlSeq(t *testing.T) {
+	conn := &Conn{SeqOffset: math.MaxUint32 - 2, SeqDelta: 2}
+	conn.once.Do(conn.init)
+
+	require.EqualValues(t, math.MaxUint32-2, conn.next())
+	require.EqualValues(t, 1, conn.next())
+}
@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package streaming_transmit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables used to pass listening sockets on to a process. LISTEN_FDS and
+// LISTEN_PID follow systemd socket activation. Processes started by StartProcess instead
+// receive the pid of their parent in ListenPPIDEnv.
+const (
+	ListenFDsEnv  = "LISTEN_FDS"
+	ListenPIDEnv  = "LISTEN_PID"
+	ListenPPIDEnv = "CARLO_LISTEN_PPID"
+)
+
+// listenFDsStart is the first file descriptor passed on to a process.
+const listenFDsStart = 3
+
+// InheritListeners returns the listening sockets passed on to the running process, either by
+// systemd socket activation or by a parent process through StartProcess. It returns no
+// listeners if none were passed on. Inherited listeners are meant to be served with
+// Server.Serve, and are to be closed by the caller.
+func InheritListeners() ([]net.Listener, error) {
+	fds, pid, ppid := os.Getenv(ListenFDsEnv), os.Getenv(ListenPIDEnv), os.Getenv(ListenPPIDEnv)
+
+	_ = os.Unsetenv(ListenFDsEnv)
+	_ = os.Unsetenv(ListenPIDEnv)
+	_ = os.Unsetenv(ListenPPIDEnv)
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) && ppid != strconv.Itoa(os.Getppid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("malformed %s '%s'", ListenFDsEnv, fds)
+	}
+
+	lns := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+
+		f := os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("failed to inherit listener from fd %d: %w", fd, err)
+		}
+
+		lns = append(lns, ln)
+	}
+
+	return lns, nil
+}
+
+// StartProcess starts a new instance of the running binary with the same arguments and
+// environment, passing lns on to it to be picked up with InheritListeners. Listeners remain
+// open in the running process, which is expected to stop serving them with Server.Drain once
+// the new process is ready.
+func StartProcess(lns ...net.Listener) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate executable: %w", err)
+	}
+	return startProcess(path, os.Args[1:], lns)
+}
+
+func startProcess(path string, args []string, lns []net.Listener) (*os.Process, error) {
+	files := make([]*os.File, 0, len(lns))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, ln := range lns {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener on %s cannot be passed on to a process", ln.Addr())
+		}
+
+		// Unix sockets must not be unlinked when they are closed by the running process, as
+		// the new process keeps serving them.
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file of listener on %s: %w", ln.Addr(), err)
+		}
+		files = append(files, f)
+	}
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "LISTEN_") || strings.HasPrefix(kv, ListenPPIDEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		ListenFDsEnv+"="+strconv.Itoa(len(files)),
+		ListenPPIDEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start process: %w", err)
+	}
+
+	return cmd.Process, nil
+}
+
+// Restart hands off all listeners served by s to a new instance of the running binary, and
+// drains s for up to drainTimeout.
+func (s *Server) Restart(drainTimeout time.Duration) (*os.Process, error) {
+	lns := s.Listeners()
+	if len(lns) == 0 {
+		return nil, errors.New("server is not serving any listeners")
+	}
+
+	p, err := StartProcess(lns...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Drain(drainTimeout)
+
+	return p, nil
+}
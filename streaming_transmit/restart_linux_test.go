@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package streaming_transmit
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+const restartHelperEnv = "CARLO_RESTART_HELPER"
+
+// TestRestartHelper is run in a process started by TestStartProcess. It serves the listener it
+// inherited until a single request has been handled.
+func TestRestartHelper(t *testing.T) {
+	if os.Getenv(restartHelperEnv) == "" {
+		t.Skip("only run as a child process")
+	}
+
+	lns, err := InheritListeners()
+	require.NoError(t, err)
+	require.Len(t, lns, 1)
+	require.Empty(t, os.Getenv(ListenFDsEnv))
+
+	handled := make(chan struct{})
+
+	srv := &Server{
+		Handler: HandlerFunc(func(ctx *Context) error {
+			defer close(handled)
+			return ctx.Reply([]byte("child"))
+		}),
+	}
+
+	go func() {
+		<-handled
+		srv.Drain(1 * time.Second)
+	}()
+
+	require.NoError(t, srv.Serve(lns[0]))
+	require.NoError(t, lns[0].Close())
+}
+
+func TestStartProcess(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	require.NoError(t, os.Setenv(restartHelperEnv, "1"))
+	defer os.Unsetenv(restartHelperEnv)
+
+	p, err := startProcess(os.Args[0], []string{"-test.run=^TestRestartHelper$"}, []net.Listener{ln})
+	require.NoError(t, err)
+
+	// The listener is closed by the parent, and served by the child from here on.
+	require.NoError(t, ln.Close())
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("who are you?"))
+	require.NoError(t, err)
+	require.EqualValues(t, "child", res)
+
+	state, err := p.Wait()
+	require.NoError(t, err)
+	require.True(t, state.Success())
+}
+
+func TestInheritListenersNone(t *testing.T) {
+	lns, err := InheritListeners()
+	require.NoError(t, err)
+	require.Empty(t, lns)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package streaming_transmit
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// InheritListeners returns no listeners, as listener handoff is only supported on linux.
+func InheritListeners() ([]net.Listener, error) { return nil, nil }
+
+// StartProcess is only supported on linux.
+func StartProcess(lns ...net.Listener) (*os.Process, error) { return nil, ErrRestartUnsupported }
+
+// Restart is only supported on linux.
+func (s *Server) Restart(drainTimeout time.Duration) (*os.Process, error) {
+	return nil, ErrRestartUnsupported
+}
@@ -2,6 +2,7 @@ package streaming_transmit
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -16,22 +17,77 @@ var DefaultMaxConnWaitTimeout = 3 * time.Second
 var DefaultServerSeqOffset uint32 = 2
 var DefaultServerSeqDelta uint32 = 2
 
+var ErrRestartUnsupported = errors.New("restarting with listener handoff is only supported on linux")
+
 type Server struct {
 	Handler   Handler
 	ConnState ConnStateHandler
 
+	// Protocols, if not empty, maps application protocol names to the Handler that serves them.
+	// Clients are then expected to offer the protocols they support right after the handshake,
+	// and connections are served by the Handler of the first offered protocol found in
+	// Protocols. Connections that offer no protocol found in Protocols, or that offer none at
+	// all, are closed.
+	Protocols map[string]Handler
+
 	Handshaker       Handshaker
 	HandshakeTimeout time.Duration
 
+	// KeyLog, if set, records the session keys of all connections in a format that allows for
+	// captured traffic to be decrypted. It is meant for debugging, and compromises security.
+	KeyLog io.Writer
+
+	// Padding, if set, pads the messages of all connections once their handshake established a
+	// session. Clients must be configured with Client.Padding as well. If only one side asks for
+	// padding, the other adopts its policy. Max defaults to ReadBufferSize.
+	Padding *PaddingPolicy
+
 	MaxConns           int
 	MaxConnWaitTimeout time.Duration
 
+	// AcceptFilter, if set, is consulted with the remote address of every accepted connection
+	// before its handshake starts. Connections it does not accept are closed.
+	AcceptFilter AcceptFilter
+
+	// AllowCIDRs, if not empty, restricts connections to remote IPs within any of the given
+	// prefixes. DenyCIDRs rejects connections from remote IPs within any of the given prefixes.
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+
+	// MaxConnsPerIP limits the number of connections a single remote IP may have open.
+	MaxConnsPerIP int
+
+	// HandshakeRate limits the number of handshakes per second a single remote IP may start,
+	// allowing for bursts of up to HandshakeBurst handshakes.
+	HandshakeRate  float64
+	HandshakeBurst int
+
+	// ProxyProtocol enables parsing PROXY protocol v1/v2 headers sent by load balancers within
+	// TrustedProxies, such that the remote address of a Conn is that of the actual client.
+	// Connections from outside TrustedProxies are never expected to send a header.
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+
+	// ConnRateLimit limits the messages handled from each connection. PeerRateLimit limits the
+	// messages handled from all connections of a peer combined, where peers are identified by
+	// their certificate subject, pre-shared key ID, or remote IP.
+	ConnRateLimit RateLimit
+	PeerRateLimit RateLimit
+
 	ReadBufferSize  int
 	WriteBufferSize int
 
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// IdleTimeout closes connections once no application traffic was sent or received over
+	// them for the given duration. MaxConnAge gracefully recycles connections once they have
+	// been open for the given duration, randomly jittered by DefaultMaxConnAgeJitter, giving
+	// pending requests up to MaxConnAgeGrace to complete.
+	IdleTimeout     time.Duration
+	MaxConnAge      time.Duration
+	MaxConnAgeGrace time.Duration
+
 	SeqOffset uint32
 	SeqDelta  uint32
 
@@ -39,13 +95,31 @@ type Server struct {
 	mu   sync.Mutex
 	wg   sync.WaitGroup
 
-	sem  chan struct{}
-	done chan struct{}
+	sem      chan struct{}
+	done     chan struct{}
+	draining chan struct{}
+
+	doneOnce     sync.Once
+	drainingOnce sync.Once
+
+	peers     map[string]*peerAdmission
+	lastSweep time.Time
+
+	limiters map[string]*peerLimiter
+
+	conns map[*Conn]struct{}
+
+	listeners map[net.Listener]bool // listeners being served, and whether the server owns them
 }
 
 func (s *Server) init() {
 	s.sem = make(chan struct{}, s.getMaxConns())
 	s.done = make(chan struct{})
+	s.draining = make(chan struct{})
+	s.peers = make(map[string]*peerAdmission)
+	s.limiters = make(map[string]*peerLimiter)
+	s.conns = make(map[*Conn]struct{})
+	s.listeners = make(map[net.Listener]bool)
 }
 
 func (s *Server) getHandler() Handler {
@@ -165,7 +239,7 @@ func (s *Server) wait(duration time.Duration) bool {
 	}
 }
 
-func (s *Server) client(conn net.Conn) error {
+func (s *Server) client(conn net.Conn, proxied bool) error {
 	defer func() { <-s.sem }()
 
 	timeout := s.getHandshakeTimeout()
@@ -177,11 +251,47 @@ func (s *Server) client(conn net.Conn) error {
 		}
 	}
 
+	if proxied {
+		var err error
+		conn, err = readProxyHeader(conn)
+		if err != nil {
+			return err
+		}
+
+		release, ok := s.admit(conn.RemoteAddr())
+		if !ok {
+			return fmt.Errorf("connection from %s was not admitted", conn.RemoteAddr())
+		}
+		defer release()
+	}
+
 	bufConn, err := s.getHandshaker().Handshake(conn)
 	if err != nil {
 		return err
 	}
 
+	if s.KeyLog != nil {
+		err = writeKeyLog(s.KeyLog, bufConn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Padding != nil {
+		err = negotiatePadding(bufConn, *s.Padding, s.getReadBufferSize(), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	protocol, handler := "", s.getHandler()
+	if len(s.Protocols) > 0 {
+		protocol, handler, err = acceptProtocol(bufConn, s.Protocols)
+		if err != nil {
+			return err
+		}
+	}
+
 	if timeout != 0 {
 		err = conn.SetDeadline(zeroTime)
 		if err != nil {
@@ -192,11 +302,33 @@ func (s *Server) client(conn net.Conn) error {
 	cc := &Conn{
 		SeqOffset:       s.getSeqOffset(),
 		SeqDelta:        s.getSeqDelta(),
-		Handler:         s.getHandler(),
+		Handler:         handler,
 		ReadBufferSize:  s.getReadBufferSize(),
 		WriteBufferSize: s.getWriteBufferSize(),
 		ReadTimeout:     s.getReadTimeout(),
 		WriteTimeout:    s.getWriteTimeout(),
+		IdleTimeout:     s.IdleTimeout,
+		MaxAge:          jitter(s.MaxConnAge),
+		MaxAgeGrace:     s.MaxConnAgeGrace,
+		bc:              bufConn,
+		protocol:        protocol,
+	}
+
+	limiters, release := s.acquireLimiters(cc)
+	defer release()
+
+	cc.limiters = limiters
+
+	s.trackConn(cc, true)
+	defer s.trackConn(cc, false)
+
+	// the connection may have been accepted after Drain recycled all connections being served
+
+	select {
+	case <-s.draining:
+		cc.once.Do(cc.init)
+		cc.recycle()
+	default:
 	}
 
 	s.getConnStateHandler().HandleConnState(cc, StateNew)
@@ -208,12 +340,148 @@ func (s *Server) client(conn net.Conn) error {
 	return nil
 }
 
+// ListenAndServe listens on the given tcp or unix socket address, and serves connections
+// accepted from it. The listener is owned by the server, and is closed on Shutdown. It may be
+// called several times to serve several listeners with one server.
+func (s *Server) ListenAndServe(network, addr string) error {
+	s.once.Do(s.init)
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return fmt.Errorf("unsupported network '%s', must be tcp/tcp4/tcp6/unix", network)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	if !s.trackListener(ln, true) {
+		_ = ln.Close()
+		return nil
+	}
+	defer s.untrackListener(ln)
+
+	return s.serve(ln)
+}
+
+// Serve accepts and serves connections from ln until Shutdown is called or ln is closed. It
+// may be called concurrently to serve several listeners with one server. The caller remains
+// the owner of ln: Shutdown makes Serve return without closing ln, and ln may be served again
+// once Serve returned.
 func (s *Server) Serve(ln net.Listener) error {
 	s.once.Do(s.init)
 
+	if !s.trackListener(ln, false) {
+		return nil
+	}
+	defer s.untrackListener(ln)
+
+	return s.serve(ln)
+}
+
+// Listeners returns all listeners that are being served, e.g. to hand them off to a new
+// process with StartProcess.
+func (s *Server) Listeners() []net.Listener {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lns := make([]net.Listener, 0, len(s.listeners))
+	for ln := range s.listeners {
+		lns = append(lns, ln)
+	}
+	return lns
+}
+
+// Addrs returns the addresses of all listeners that are being served.
+func (s *Server) Addrs() []net.Addr {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for ln := range s.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// trackListener registers ln to be served. It returns false if the server is shut down.
+func (s *Server) trackListener(ln net.Listener, owned bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return false
+	case <-s.draining:
+		return false
+	default:
+	}
+
+	if _, exists := s.listeners[ln]; !exists {
+		s.listeners[ln] = owned
+	}
+	return true
+}
+
+// untrackListener stops serving ln. The deadline unblockListeners may have set on a listener
+// owned by the caller is cleared, such that it may be served again or handed off.
+func (s *Server) untrackListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owned := s.listeners[ln]
+	delete(s.listeners, ln)
+
+	if owned {
+		return
+	}
+
+	select {
+	case <-s.done:
+	case <-s.draining:
+	default:
+		return
+	}
+
+	if dl, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = dl.SetDeadline(time.Time{})
+	}
+}
+
+// unblockListeners makes all pending calls to Accept return. Owned listeners are closed,
+// while listeners owned by the caller are only interrupted by an expired deadline.
+func (s *Server) unblockListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ln, owned := range s.listeners {
+		if owned {
+			_ = ln.Close()
+			continue
+		}
+		if dl, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+			_ = dl.SetDeadline(time.Now())
+		}
+	}
+}
+
+func (s *Server) serve(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			case <-s.draining:
+				return nil
+			default:
+			}
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
@@ -234,7 +502,22 @@ func (s *Server) Serve(ln net.Listener) error {
 			continue
 		}
 
+		// connections from trusted proxies are admitted once their actual remote address
+		// is known
+
+		proxied := s.isTrustedProxy(conn.RemoteAddr())
+
+		release, ok := func() {}, true
+		if !proxied {
+			release, ok = s.admit(conn.RemoteAddr())
+		}
+		if !ok {
+			conn.Close()
+			continue
+		}
+
 		if !s.serverAvailable() {
+			release()
 			conn.Close()
 			continue
 		}
@@ -243,15 +526,131 @@ func (s *Server) Serve(ln net.Listener) error {
 
 		go func() {
 			defer s.wg.Done()
-			s.client(conn)
+			defer release()
+			s.client(conn, proxied)
 			conn.Close()
 		}()
+
+		// a connection accepted as the server started draining is still served, as its
+		// client would otherwise be dropped, but no more connections are accepted
+
+		select {
+		case <-s.draining:
+			return nil
+		default:
+		}
 	}
 }
 
+func (s *Server) trackConn(conn *Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+// Conns returns all connections the server is currently serving.
+func (s *Server) Conns() []*Conn {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Broadcast sends payload to all connections the server is currently serving, and waits for
+// it to be written to each of them. It returns the errors of the connections payload could not
+// be sent to, keyed by connection.
+func (s *Server) Broadcast(payload []byte) map[*Conn]error {
+	conns := s.Conns()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs map[*Conn]error
+	)
+
+	wg.Add(len(conns))
+	for _, conn := range conns {
+		conn := conn
+		go func() {
+			defer wg.Done()
+
+			err := conn.Send(payload)
+			if err == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if errs == nil {
+				errs = make(map[*Conn]error)
+			}
+			errs[conn] = err
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// CloseConns closes all connections the server is serving for which pred returns true for the
+// given reason, and returns the number of connections closed.
+func (s *Server) CloseConns(pred func(conn *Conn) bool, reason error) int {
+	closed := 0
+	for _, conn := range s.Conns() {
+		if pred(conn) {
+			conn.Close(reason)
+			closed++
+		}
+	}
+	return closed
+}
+
+// Drain stops the server from accepting new connections, recycles all of its connections, and
+// waits up to timeout for them to be closed before shutting the server down. It is meant for
+// handing off listeners to a new process without refusing any connections.
+func (s *Server) Drain(timeout time.Duration) {
+	s.once.Do(s.init)
+
+	s.drainingOnce.Do(func() { close(s.draining) })
+	s.unblockListeners()
+
+	for _, conn := range s.Conns() {
+		conn.recycle()
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(closed)
+	}()
+
+	timer := timerPool.acquire(timeout)
+	defer timerPool.release(timer)
+
+	select {
+	case <-closed:
+	case <-timer.C:
+	}
+
+	s.Shutdown()
+}
+
 func (s *Server) Shutdown() {
 	s.once.Do(s.init)
 
-	close(s.done)
+	s.doneOnce.Do(func() { close(s.done) })
+	s.unblockListeners()
 	s.wg.Wait()
 }
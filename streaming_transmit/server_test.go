@@ -1,13 +1,35 @@
 package streaming_transmit
 
 import (
+	"errors"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 )
 
+// serveTest serves server on a random local port, and returns its address along with a func
+// that shuts server down and closes its listener.
+func serveTest(t *testing.T, server *Server) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	return ln.Addr().String(), func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}
+}
+
 func TestServerShutdown(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -23,3 +45,279 @@ func TestServerShutdown(t *testing.T) {
 
 	require.NoError(t, srv.Serve(ln))
 }
+
+func TestServerShutdownUnblocksServe(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	srv := &Server{}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	require.Eventually(t, func() bool { return len(srv.Addrs()) == 1 }, 1*time.Second, 10*time.Millisecond)
+
+	srv.Shutdown()
+
+	select {
+	case err := <-errs:
+		require.NoError(t, err)
+	case <-time.After(1 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+
+	// the listener no longer has the deadline that interrupted Serve, and may be served again
+
+	next := &Server{Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply(ctx.Body()) })}
+
+	go func() {
+		errs <- next.Serve(ln)
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	next.Shutdown()
+	require.NoError(t, <-errs)
+}
+
+func TestServerListenAndServe(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "streaming_transmit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "server.sock")
+
+	srv := &Server{
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply(ctx.Body())
+		}),
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- srv.ListenAndServe("tcp", "127.0.0.1:0") }()
+	go func() { errs <- srv.ListenAndServe("unix", sock) }()
+
+	require.Eventually(t, func() bool { return len(srv.Addrs()) == 2 }, 1*time.Second, 10*time.Millisecond)
+
+	for _, addr := range srv.Addrs() {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		require.NoError(t, err)
+
+		var session Session
+		require.NoError(t, session.DoClient(conn))
+		require.NoError(t, conn.Close())
+	}
+
+	srv.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	_, err = os.Stat(sock)
+	require.True(t, os.IsNotExist(err))
+
+	require.Error(t, srv.ListenAndServe("udp", "127.0.0.1:0"))
+}
+
+func TestServerDrain(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	srv := &Server{}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	// Idle connections are recycled, rather than waited on until the timeout.
+
+	start := time.Now()
+	srv.Drain(5 * time.Second)
+	require.True(t, time.Since(start) < 1*time.Second)
+	require.True(t, conn.Draining())
+
+	require.NoError(t, <-errs)
+
+	srv.Shutdown()
+}
+
+// drainingListener starts draining srv right after accepting a connection.
+type drainingListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (ln drainingListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err == nil {
+		ln.srv.drainingOnce.Do(func() { close(ln.srv.draining) })
+	}
+	return conn, err
+}
+
+func TestServerDrainServesAcceptedConn(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	srv := &Server{}
+	srv.once.Do(srv.init)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(drainingListener{Listener: ln, srv: srv})
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	// the connection accepted as the server started draining completes its handshake, and is
+	// recycled rather than dropped
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return conn.Draining() }, 1*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, <-errs)
+
+	srv.Shutdown()
+}
+
+func TestServerConnsBroadcastAndClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	release := make(chan struct{})
+
+	srv := &Server{
+		Handler: HandlerFunc(func(ctx *Context) error {
+			<-release
+			return ctx.Reply(ctx.Body())
+		}),
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+
+	newClient := func(name string) *Client {
+		return &Client{
+			Addr: ln.Addr().String(),
+			Handler: HandlerFunc(func(ctx *Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received[name+": "+string(ctx.Body())]++
+				return nil
+			}),
+		}
+	}
+
+	a, b := newClient("a"), newClient("b")
+
+	defer func() {
+		srv.Shutdown()
+		a.Shutdown()
+		b.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	aconn, err := a.Get()
+	require.NoError(t, err)
+
+	_, err = b.Get()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(srv.Conns()) == 2 }, 1*time.Second, 10*time.Millisecond)
+
+	require.Empty(t, srv.Broadcast([]byte("hello")))
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received["a: hello"] == 1 && received["b: hello"] == 1
+	}, 1*time.Second, 10*time.Millisecond)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.Request(nil, []byte("pending"))
+		errs <- err
+	}()
+
+	kicked := errors.New("kicked")
+	require.Eventually(t, func() bool {
+		return srv.CloseConns(func(conn *Conn) bool {
+			return conn.RemoteAddr().String() == aconn.LocalAddr().String() && conn.Stats().MessagesRead == 1
+		}, kicked) == 1
+	}, 1*time.Second, 10*time.Millisecond)
+
+	err = <-errs
+	require.True(t, errors.Is(err, ErrConnClosedByPeer), err)
+	require.Contains(t, err.Error(), "kicked")
+
+	close(release)
+
+	require.Eventually(t, func() bool { return len(srv.Conns()) == 1 }, 1*time.Second, 10*time.Millisecond)
+}
+
+func TestConnClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	srv := &Server{}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+
+	defer func() {
+		srv.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(srv.Conns()) == 1 }, 1*time.Second, 10*time.Millisecond)
+
+	conn.Close(nil)
+	conn.Close(nil)
+
+	require.Eventually(t, func() bool { return len(srv.Conns()) == 0 }, 1*time.Second, 10*time.Millisecond)
+}
@@ -4,10 +4,14 @@ import (
 	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
+	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	mrand "math/rand"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/lithdew/bytesutil"
@@ -26,6 +30,8 @@ var _ BufferedConn = (*SessionConn)(nil)
 // The same cipher.AEAD suite must not be used for multiple SessionConn instances. Doing
 // so will cause for plaintext data to be leaked.
 type SessionConn struct {
+	stats SessionStats // must be first for 64-bit alignment of atomic counters
+
 	suite cipher.AEAD
 	conn  net.Conn
 
@@ -34,8 +40,30 @@ type SessionConn struct {
 
 	rb []byte // read buffer
 	wb []byte // write buffer
+	pb []byte // padded write buffer
 	wn uint64 // write nonce
 	rn uint64 // read nonce
+
+	padded  bool          // whether messages are prefixed with their length and padded
+	padding PaddingPolicy // how messages written are padded
+	rng     *mrand.Rand   // source of randomness for PaddingRandom
+
+	sessionKey []byte // session key, recorded for key logging
+	clientPub  []byte // ephemeral public key of the client, recorded for key logging
+}
+
+// SessionStats are counters of the traffic that went through a SessionConn. Bytes are
+// plaintext bytes, while wire bytes additionally include framing, padding and authentication
+// tags.
+type SessionStats struct {
+	MessagesRead     uint64
+	MessagesWritten  uint64
+	BytesRead        uint64
+	BytesWritten     uint64
+	WireBytesRead    uint64
+	WireBytesWritten uint64
+	PaddingRead      uint64
+	PaddingWritten   uint64
 }
 
 func NewSessionConn(suite cipher.AEAD, conn net.Conn) *SessionConn {
@@ -54,6 +82,8 @@ func (s *SessionConn) Read(b []byte) (int, error) {
 		return 0, err
 	}
 
+	wire := 4 + len(s.rb)
+
 	s.rb = bytesutil.ExtendSlice(s.rb, len(s.rb)+s.suite.NonceSize())
 	for i := len(s.rb) - s.suite.NonceSize(); i < len(s.rb); i++ {
 		s.rb[i] = 0
@@ -70,11 +100,44 @@ func (s *SessionConn) Read(b []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return copy(b, s.rb), err
+
+	data := s.rb
+	if s.padded {
+		if len(data) < 4 {
+			return 0, fmt.Errorf("no padded message length to decode: %w", io.ErrUnexpectedEOF)
+		}
+		n := bytesutil.Uint32BE(data[:4])
+		if uint64(n) > uint64(len(data)-4) {
+			return 0, fmt.Errorf("padded message length is %d bytes, but only got %d bytes", n, len(data)-4)
+		}
+		data = data[4 : 4+n]
+		atomic.AddUint64(&s.stats.PaddingRead, uint64(len(s.rb)-len(data)))
+	}
+
+	atomic.AddUint64(&s.stats.MessagesRead, 1)
+	atomic.AddUint64(&s.stats.BytesRead, uint64(len(data)))
+	atomic.AddUint64(&s.stats.WireBytesRead, uint64(wire))
+
+	return copy(b, data), err
 }
 
 func (s *SessionConn) Write(b []byte) (int, error) {
-	s.wb = bytesutil.ExtendSlice(s.wb, s.suite.NonceSize()+len(b)+s.suite.Overhead())
+	plaintext := b
+	if s.padded {
+		padding := s.padding.padding(4+len(b)+s.suite.Overhead(), s.rng.Intn)
+
+		s.pb = bytesutil.ExtendSlice(s.pb, 4+len(b)+padding)
+		binary.BigEndian.PutUint32(s.pb[:4], uint32(len(b)))
+		copy(s.pb[4:], b)
+		for i := 4 + len(b); i < len(s.pb); i++ {
+			s.pb[i] = 0
+		}
+		plaintext = s.pb
+
+		atomic.AddUint64(&s.stats.PaddingWritten, uint64(len(s.pb)-len(b)))
+	}
+
+	s.wb = bytesutil.ExtendSlice(s.wb, s.suite.NonceSize()+len(plaintext)+s.suite.Overhead())
 	binary.BigEndian.PutUint64(s.wb[:8], s.wn)
 	for i := 8; i < s.suite.NonceSize(); i++ {
 		s.wb[i] = 0
@@ -84,7 +147,7 @@ func (s *SessionConn) Write(b []byte) (int, error) {
 	s.wb = s.suite.Seal(
 		s.wb[s.suite.NonceSize():s.suite.NonceSize()],
 		s.wb[:s.suite.NonceSize()],
-		b,
+		plaintext,
 		nil,
 	)
 
@@ -93,11 +156,49 @@ func (s *SessionConn) Write(b []byte) (int, error) {
 		return 0, err
 	}
 
+	atomic.AddUint64(&s.stats.MessagesWritten, 1)
+	atomic.AddUint64(&s.stats.BytesWritten, uint64(len(b)))
+	atomic.AddUint64(&s.stats.WireBytesWritten, uint64(4+len(s.wb)))
+
 	return len(s.wb), nil
 }
 
 func (s *SessionConn) Flush() error { return s.bw.Flush() }
 
+// SessionKey returns the key messages are encrypted with, or nil if the SessionConn was not
+// created from a Session.
+func (s *SessionConn) SessionKey() []byte { return s.sessionKey }
+
+// ClientPublicKey returns the ephemeral public key the client sent at the start of the
+// handshake, or nil if the SessionConn was not created from a Session.
+func (s *SessionConn) ClientPublicKey() []byte { return s.clientPub }
+
+// Stats returns a snapshot of the traffic counters of the SessionConn. It is safe to call
+// concurrently with reads and writes.
+func (s *SessionConn) Stats() SessionStats {
+	return SessionStats{
+		MessagesRead:     atomic.LoadUint64(&s.stats.MessagesRead),
+		MessagesWritten:  atomic.LoadUint64(&s.stats.MessagesWritten),
+		BytesRead:        atomic.LoadUint64(&s.stats.BytesRead),
+		BytesWritten:     atomic.LoadUint64(&s.stats.BytesWritten),
+		WireBytesRead:    atomic.LoadUint64(&s.stats.WireBytesRead),
+		WireBytesWritten: atomic.LoadUint64(&s.stats.WireBytesWritten),
+		PaddingRead:      atomic.LoadUint64(&s.stats.PaddingRead),
+		PaddingWritten:   atomic.LoadUint64(&s.stats.PaddingWritten),
+	}
+}
+
+// setPadding makes all messages read to be expected to be padded, and all messages written
+// to be padded per the given policy.
+func (s *SessionConn) setPadding(policy PaddingPolicy) {
+	var seed [8]byte
+	_, _ = crand.Read(seed[:])
+
+	s.padded = true
+	s.padding = policy
+	s.rng = mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))
+}
+
 func (s *SessionConn) Close() error                       { return s.conn.Close() }
 func (s *SessionConn) LocalAddr() net.Addr                { return s.conn.LocalAddr() }
 func (s *SessionConn) RemoteAddr() net.Addr               { return s.conn.RemoteAddr() }
@@ -108,7 +209,9 @@ func (s *SessionConn) SetWriteDeadline(t time.Time) error { return s.conn.SetWri
 // Session is not safe for concurrent use.
 type Session struct {
 	suite     cipher.AEAD
+	ourPub    []byte
 	theirPub  []byte
+	clientPub []byte
 	sharedKey []byte
 }
 
@@ -120,11 +223,26 @@ func (s *Session) SharedKey() []byte {
 	return s.sharedKey
 }
 
+// ClientPublicKey returns the ephemeral public key the client sent at the start of the
+// handshake. It identifies the session in a key log.
+func (s *Session) ClientPublicKey() []byte {
+	return s.clientPub
+}
+
+// NewConn wraps conn such that all messages are encrypted with the established session key.
+func (s *Session) NewConn(conn net.Conn) *SessionConn {
+	sc := NewSessionConn(s.suite, conn)
+	sc.sessionKey = s.sharedKey
+	sc.clientPub = s.clientPub
+	return sc
+}
+
 func (s *Session) Write(conn net.Conn, ourPub []byte) error {
 	err := Write(conn, ourPub)
 	if err != nil {
 		return fmt.Errorf("failed to write session public key: %w", err)
 	}
+	s.ourPub = ourPub
 	return nil
 }
 
@@ -138,6 +256,21 @@ func (s *Session) Read(conn net.Conn) error {
 }
 
 func (s *Session) Establish(ourPriv []byte) error {
+	return s.establish(ourPriv, nil)
+}
+
+// EstablishWithPSK is like Establish, except that the given pre-shared key is mixed into the
+// derivation of the session key. Peers that do not hold the same pre-shared key end up with
+// different session keys.
+func (s *Session) EstablishWithPSK(ourPriv, psk []byte) error {
+	if len(psk) < MinPSKSize || len(psk) > MaxPSKSize {
+		return fmt.Errorf("pre-shared key must be between %d and %d bytes, got %d bytes",
+			MinPSKSize, MaxPSKSize, len(psk))
+	}
+	return s.establish(ourPriv, psk)
+}
+
+func (s *Session) establish(ourPriv, psk []byte) error {
 	if s.theirPub == nil {
 		return errors.New("did not read peer session public key yet")
 	}
@@ -145,20 +278,38 @@ func (s *Session) Establish(ourPriv []byte) error {
 	if err != nil {
 		return fmt.Errorf("failed to derive shared session key: %w", err)
 	}
-	derivedKey := blake2b.Sum256(sharedKey)
-	block, err := aes.NewCipher(derivedKey[:])
-	if err != nil {
-		return fmt.Errorf("failed to init aes cipher: %w", err)
+	var derivedKey [blake2b.Size256]byte
+	if psk == nil {
+		derivedKey = blake2b.Sum256(sharedKey)
+	} else {
+		h, err := blake2b.New256(psk)
+		if err != nil {
+			return fmt.Errorf("failed to init keyed hash: %w", err)
+		}
+		_, _ = h.Write(sharedKey)
+		h.Sum(derivedKey[:0])
 	}
-	suite, err := cipher.NewGCM(block)
+	suite, err := newSessionSuite(derivedKey[:])
 	if err != nil {
-		return fmt.Errorf("failed to init aead suite: %w", err)
+		return err
 	}
 	s.sharedKey = derivedKey[:]
 	s.suite = suite
 	return nil
 }
 
+func newSessionSuite(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init aes cipher: %w", err)
+	}
+	suite, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init aead suite: %w", err)
+	}
+	return suite, nil
+}
+
 func (s *Session) GenerateEphemeralKeys() ([]byte, []byte, error) {
 	publicKey, privateKey, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -187,6 +338,7 @@ func (s *Session) DoClient(conn net.Conn) error {
 	if err == nil {
 		err = s.Establish(ourPriv)
 	}
+	s.clientPub = s.ourPub
 	return err
 }
 
@@ -202,5 +354,6 @@ func (s *Session) DoServer(conn net.Conn) error {
 	if err == nil {
 		err = s.Establish(ourPriv)
 	}
+	s.clientPub = s.theirPub
 	return err
 }
@@ -0,0 +1,108 @@
+package streaming_transmit
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+var _ BufferedConn = (*TLSConn)(nil)
+
+// TLSConn is not safe for concurrent use. It frames messages over a TLS connection the same
+// way SessionConn does, prefixing each message with a 32-bit unsigned integer that designates
+// its length.
+type TLSConn struct {
+	conn *tls.Conn
+
+	bw *bufio.Writer
+	br *bufio.Reader
+
+	rb []byte  // read buffer
+	wh [4]byte // write header
+}
+
+func NewTLSConn(conn *tls.Conn) *TLSConn {
+	return &TLSConn{
+		conn: conn,
+
+		bw: bufio.NewWriter(conn),
+		br: bufio.NewReader(conn),
+	}
+}
+
+func (c *TLSConn) Read(b []byte) (int, error) {
+	var err error
+	c.rb, err = ReadSized(c.rb[:0], c.br, cap(b))
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, c.rb), nil
+}
+
+func (c *TLSConn) Write(b []byte) (int, error) {
+	binary.BigEndian.PutUint32(c.wh[:], uint32(len(b)))
+	_, err := c.bw.Write(c.wh[:])
+	if err == nil {
+		_, err = c.bw.Write(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *TLSConn) Flush() error { return c.bw.Flush() }
+
+// ConnectionState returns details about the TLS connection, including the certificate chain
+// presented by the peer.
+func (c *TLSConn) ConnectionState() tls.ConnectionState { return c.conn.ConnectionState() }
+
+func (c *TLSConn) Close() error                       { return c.conn.Close() }
+func (c *TLSConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *TLSConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *TLSConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *TLSConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *TLSConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// TLSClientHandshaker returns a Handshaker that performs a TLS 1.3 client handshake using
+// config. Mutual authentication is enabled by providing config.Certificates.
+func TLSClientHandshaker(config *tls.Config) HandshakerFunc {
+	config = tls13Config(config)
+	return func(conn net.Conn) (BufferedConn, error) {
+		tc := tls.Client(conn, config)
+		err := tc.Handshake()
+		if err != nil {
+			return nil, fmt.Errorf("tls handshake failed: %w", err)
+		}
+		return NewTLSConn(tc), nil
+	}
+}
+
+// TLSServerHandshaker returns a Handshaker that performs a TLS 1.3 server handshake using
+// config. Mutual authentication is enabled by setting config.ClientAuth.
+func TLSServerHandshaker(config *tls.Config) HandshakerFunc {
+	config = tls13Config(config)
+	return func(conn net.Conn) (BufferedConn, error) {
+		tc := tls.Server(conn, config)
+		err := tc.Handshake()
+		if err != nil {
+			return nil, fmt.Errorf("tls handshake failed: %w", err)
+		}
+		return NewTLSConn(tc), nil
+	}
+}
+
+func tls13Config(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.MinVersion < tls.VersionTLS13 {
+		config.MinVersion = tls.VersionTLS13
+	}
+	return config
+}
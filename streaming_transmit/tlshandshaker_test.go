@@ -0,0 +1,106 @@
+package streaming_transmit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func issueTestTLSCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert, key
+}
+
+func TestTLSClientServer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	_, caCert, caKey := issueTestTLSCertificate(t, "ca", nil, nil)
+	serverCert, _, _ := issueTestTLSCertificate(t, "localhost", caCert, caKey)
+	clientCert, _, _ := issueTestTLSCertificate(t, "billing", caCert, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{
+		Handshaker: TLSServerHandshaker(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}),
+		Handler: HandlerFunc(func(ctx *Context) error {
+			chain := ctx.Conn().PeerCertificateChain()
+			return ctx.Reply([]byte(chain[0].Subject.CommonName))
+		}),
+	}
+
+	client := &Client{
+		Addr: ln.Addr().String(),
+		Handshaker: TLSClientHandshaker(&tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+			ServerName:   "localhost",
+		}),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	for i := 0; i < 16; i++ {
+		res, err := client.Request(nil, []byte("who am i?"))
+		require.NoError(t, err)
+		require.EqualValues(t, "billing", res)
+	}
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	state, ok := conn.TLSConnectionState()
+	require.True(t, ok)
+	require.EqualValues(t, tls.VersionTLS13, state.Version)
+	require.Equal(t, "localhost", conn.PeerCertificateChain()[0].Subject.CommonName)
+}
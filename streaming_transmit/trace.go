@@ -0,0 +1,56 @@
+package streaming_transmit
+
+import "context"
+
+// ClientTrace is a set of hooks that are notified of the lifecycle of connections established
+// and messages sent by a Client. Any of its hooks may be nil. Hooks may be called from
+// different goroutines, and must not block.
+type ClientTrace struct {
+	// GetConn is called before a connection to addr is retrieved from the pool, or established
+	// if there is none to spare. GotConn is called once the connection is ready to be used.
+	GetConn func(addr string)
+	GotConn func(conn *Conn)
+
+	// DialStart and DialDone are called before and after dialing a new connection.
+	DialStart func(network, addr string)
+	DialDone  func(network, addr string, err error)
+
+	// HandshakeStart and HandshakeDone are called before and after the handshake of a new
+	// connection, including negotiating its application protocol.
+	HandshakeStart func()
+	HandshakeDone  func(err error)
+
+	// WriteQueued is called once a message sent with seq is queued to be written, and Flushed
+	// once it is flushed out to the connection.
+	WriteQueued func(seq uint32)
+	Flushed     func(seq uint32, err error)
+
+	// ResponseReceived is called once the response to the request sent with seq is received.
+	ResponseReceived func(seq uint32)
+}
+
+type clientTraceKey struct{}
+
+// WithClientTrace returns a copy of ctx that carries trace, such that requests made with it
+// notify trace instead of the ClientTrace of a Client.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace returns the ClientTrace carried by ctx, or nil if there is none.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// pendingFlush is a traced write waiting to be flushed.
+type pendingFlush struct {
+	seq   uint32
+	trace *ClientTrace
+}
+
+func traceFlushed(flushes []pendingFlush, err error) {
+	for _, f := range flushes {
+		f.trace.Flushed(f.seq, err)
+	}
+}
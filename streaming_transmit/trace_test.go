@@ -0,0 +1,187 @@
+package streaming_transmit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+type traceRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *traceRecorder) record(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *traceRecorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *traceRecorder) trace() *ClientTrace {
+	return &ClientTrace{
+		GetConn:          func(addr string) { r.record("get conn") },
+		GotConn:          func(conn *Conn) { r.record("got conn") },
+		DialStart:        func(network, addr string) { r.record("dial start") },
+		DialDone:         func(network, addr string, err error) { r.record("dial done %v", err) },
+		HandshakeStart:   func() { r.record("handshake start") },
+		HandshakeDone:    func(err error) { r.record("handshake done %v", err) },
+		WriteQueued:      func(seq uint32) { r.record("write queued %d", seq) },
+		Flushed:          func(seq uint32, err error) { r.record("flushed %d %v", seq, err) },
+		ResponseReceived: func(seq uint32) { r.record("response received %d", seq) },
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &Server{
+		Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply(ctx.Body()) }),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	var client, request traceRecorder
+
+	c := &Client{Addr: ln.Addr().String(), Trace: client.trace()}
+
+	defer func() {
+		server.Shutdown()
+		c.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	_, err = c.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+
+	events := client.recorded()
+	require.Equal(t, []string{
+		"get conn",
+		"dial start",
+		"dial done <nil>",
+		"handshake start",
+		"handshake done <nil>",
+		"got conn",
+		"write queued 1",
+	}, events[:7])
+	require.ElementsMatch(t, []string{"flushed 1 <nil>", "response received 1"}, events[7:])
+
+	// A trace attached to the context of a request overrides the trace of the client.
+
+	_, err = c.RequestContext(WithClientTrace(context.Background(), request.trace()), nil, []byte("hello"))
+	require.NoError(t, err)
+
+	events = request.recorded()
+	require.Equal(t, []string{"get conn", "got conn", "write queued 3"}, events[:3])
+	require.ElementsMatch(t, []string{"flushed 3 <nil>", "response received 3"}, events[3:])
+	require.Len(t, client.recorded(), 9)
+}
+
+func TestClientRequestContextCanceled(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	release := make(chan struct{})
+
+	server := &Server{
+		Handler: HandlerFunc(func(ctx *Context) error {
+			<-release
+			return ctx.Reply(ctx.Body())
+		}),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	c := &Client{Addr: ln.Addr().String()}
+
+	defer func() {
+		close(release)
+		server.Shutdown()
+		c.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.RequestContext(ctx, nil, []byte("hello"))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	conn, err := c.Get()
+	require.NoError(t, err)
+	require.Zero(t, conn.numPendingRequests())
+}
+
+func TestClientRequestContextCanceledWhileDialing(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// the listener never completes a handshake
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	c := &Client{Addr: ln.Addr().String(), HandshakeTimeout: 5 * time.Second}
+
+	defer func() {
+		c.Shutdown()
+		require.NoError(t, (<-accepted).Close())
+		require.NoError(t, ln.Close())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = c.RequestContext(ctx, nil, []byte("hello"))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestConnCanceledRequestsExpire(t *testing.T) {
+	c := &Conn{}
+	c.once.Do(c.init)
+
+	now := time.Now()
+
+	c.mu.Lock()
+	c.cancel(1, now)
+	c.cancel(3, now.Add(DefaultCanceledRequestExpiry))
+	c.mu.Unlock()
+
+	// the first request expired by the time the second one was canceled
+
+	require.Len(t, c.canceled, 1)
+	require.Contains(t, c.canceled, uint32(3))
+
+	c.close(ErrConnClosed)
+	require.Len(t, c.canceled, 0)
+}